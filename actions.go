@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 // CreateInstance
@@ -21,7 +23,7 @@ import (
 //   "organization_guid": "org-guid-here",
 //   "space_guid":        "space-guid-here"
 // }
-func CreateInstance(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, s *Settings) {
+func CreateInstance(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, l *Logger) {
 	instance := Instance{}
 
 	db.Where("uuid = ?", p["id"]).First(&instance)
@@ -37,13 +39,20 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, db *go
 		body, _ := ioutil.ReadAll(req.Body)
 
 		json.Unmarshal(body, &sr)
+		instance.ServiceId = sr.ServiceId
 		instance.PlanId = sr.PlainId
 		instance.OrgGuid = sr.OrganizationGuid
 		instance.SpaceGuid = sr.SpaceGuid
+		instance.Parameters = string(sr.Parameters)
 	}
 
 	instance.Uuid = p["id"]
 
+	if FindPlan(instance.PlanId) == nil {
+		r.JSON(400, Response{"The plan " + instance.PlanId + " is not in the catalog"})
+		return
+	}
+
 	instance.Database = "db" + randStr(15)
 	instance.Username = "u" + randStr(15)
 	instance.Salt = GenerateSalt(aes.BlockSize)
@@ -55,15 +64,169 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, db *go
 		return
 	}
 
+	host, err := hosts.Place(&instance, db)
+	if err != nil {
+		r.JSON(500, Response{"There was an error placing the instance: " + err.Error()})
+		return
+	}
+	instance.Host = host.Name
+
+	op, err := ReserveQuotas(db, s.Dialect, &instance)
+	if _, ok := err.(*QuotaError); ok {
+		r.JSON(403, Response{err.Error()})
+		return
+	}
+	if err != nil {
+		l.Error("Error reserving the quotas", err)
+		r.JSON(500, Response{"There was an error creating the instance"})
+		return
+	}
+
 	// Create the database
 	// TODO: Move to interface
-	db.Exec(fmt.Sprintf("CREATE DATABASE %s;", instance.Database))
-	db.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", instance.Username, password))
-	db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", instance.Database, instance.Username))
+	err = execAllWith(hostExec, host.DB, l, []string{
+		fmt.Sprintf("CREATE DATABASE %s;", instance.Database),
+		fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s';", instance.Username, password),
+		fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", instance.Database, instance.Username),
+	})
+	if err == nil {
+		err = ApplyProfile(host.DB, &instance, nil, l)
+	}
+	if err == nil {
+		if err = db.Save(&instance).Error; err != nil {
+			l.Error("Error saving the instance", err)
+		}
+	}
+	if err != nil {
+		undoProvision(db, host, &instance, op, l)
+		r.JSON(500, Response{"There was an error creating the instance"})
+		return
+	}
+	op.Finish(db)
+	l.Info("Created instance", "host", host.Name, "plan_id", instance.PlanId)
 
-	db.Save(&instance)
+	response := map[string]string{"description": "The instance was created"}
+	if url := s.DashboardFor(&instance); url != "" {
+		response["dashboard_url"] = url
+	}
+	r.JSON(201, response)
+}
 
-	r.JSON(201, Response{"The instance was created"})
+// undoProvision drops what a failed provision made. When that fails too the
+// operation is left abandoned, for ResumeOperations to clean up.
+func undoProvision(db *gorm.DB, host *BackingHost, instance *Instance, op *PendingOperation, l *Logger) {
+	err := execAllWith(hostExec, host.DB, l, []string{
+		fmt.Sprintf("DROP DATABASE IF EXISTS %s;", instance.Database),
+		fmt.Sprintf("DROP USER IF EXISTS %s;", instance.Username),
+	})
+	if err != nil {
+		op.Abandon(db)
+		return
+	}
+	op.Finish(db)
+}
+
+// GetInstance
+// URL: /v2/service_instances/:id
+func GetInstance(p martini.Params, r render.Render, db *gorm.DB, s *Settings) {
+	instance := Instance{}
+
+	db.Where("uuid = ?", p["id"]).First(&instance)
+
+	if instance.Id == 0 {
+		r.JSON(404, Response{"Instance not found"})
+		return
+	}
+
+	response := instanceResponse{
+		ServiceId:    instance.ServiceId,
+		PlanId:       instance.PlanId,
+		DashboardUrl: s.DashboardFor(&instance),
+	}
+	if instance.Parameters != "" {
+		response.Parameters = json.RawMessage(instance.Parameters)
+	}
+	r.JSON(200, response)
+}
+
+// UpdateInstance
+// URL: /v2/service_instances/:id
+// Request:
+// {
+//   "service_id": "service-guid-here",
+//   "plan_id":    "new-plan-guid-here"
+// }
+// An instance read-only for being over its storage limit is checked again
+// right away, so a plan with more storage makes it writable.
+func UpdateInstance(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, l *Logger) {
+	instance := Instance{}
+
+	db.Where("uuid = ?", p["id"]).First(&instance)
+
+	if instance.Id == 0 {
+		r.JSON(404, Response{"Instance not found"})
+		return
+	}
+
+	var sr serviceReq
+
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		json.Unmarshal(body, &sr)
+	}
+
+	if sr.PlainId == "" || sr.PlainId == instance.PlanId {
+		var emptyJson struct{}
+		r.JSON(200, emptyJson)
+		return
+	}
+
+	if FindPlan(sr.PlainId) == nil {
+		r.JSON(400, Response{"The plan " + sr.PlainId + " is not in the catalog"})
+		return
+	}
+
+	if err := CheckQuota(db, QuotaScopePlan, sr.PlainId); err != nil {
+		r.JSON(403, Response{err.Error()})
+		return
+	}
+
+	host, err := hosts.HostFor(&instance)
+	if err != nil {
+		r.JSON(500, Response{err.Error()})
+		return
+	}
+
+	var bindings []Binding
+	db.Where("instance_uuid = ? AND username <> ''", instance.Uuid).Find(&bindings)
+
+	previous := instance
+	instance.PlanId = sr.PlainId
+	err = ApplyProfile(host.DB, &instance, bindings, l)
+	if err == nil {
+		if err = db.Save(&instance).Error; err != nil {
+			l.Error("Error saving the instance", err)
+		}
+	}
+	if err != nil {
+		// The roles keep the profile of the plan the instance stays on
+		if err := ApplyProfile(host.DB, &previous, bindings, l); err != nil {
+			l.Error("Error applying the profile of the previous plan back", err)
+		}
+		r.JSON(500, Response{"There was an error changing the plan"})
+		return
+	}
+	l.Info("Changed the instance plan", "plan_id", instance.PlanId)
+
+	if instance.StorageState == StorageReadOnly {
+		if err := NewStorageMonitor(db, hosts, s).Check(&instance); err != nil {
+			l.Error("Error checking the storage", err)
+		}
+	}
+
+	var emptyJson struct{}
+	r.JSON(200, emptyJson)
 }
 
 // BindInstance
@@ -74,7 +237,8 @@ func CreateInstance(p martini.Params, req *http.Request, r render.Render, db *go
 //   "service_id":     "service-guid-here",
 //   "app_guid":       "app-guid-here"
 // }
-func BindInstance(p martini.Params, r render.Render, db *gorm.DB, s *Settings) {
+// With accepts_incomplete=true the binding is made in the background.
+func BindInstance(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, jobs *Jobs, s *Settings, l *Logger) {
 	instance := Instance{}
 
 	db.Where("uuid = ?", p["instance_id"]).First(&instance)
@@ -83,30 +247,274 @@ func BindInstance(p martini.Params, r render.Render, db *gorm.DB, s *Settings) {
 		return
 	}
 
+	async := req.URL.Query().Get("accepts_incomplete") == "true"
+
+	var br bindReq
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &br)
+	}
+	requested := Binding{}
+	if err := requested.SetBindRequest(&br); err != nil {
+		r.JSON(400, Response{err.Error()})
+		return
+	}
+
+	binding := Binding{}
+	db.Where("uuid = ? AND instance_uuid = ?", p["id"], instance.Uuid).First(&binding)
+
+	if binding.Id > 0 && binding.Operation == OperationBind && binding.State != StateFailed && !binding.SameRequest(&requested) {
+		r.JSON(409, Response{"The binding already exists with other parameters"})
+		return
+	}
+
+	if binding.Id > 0 && binding.State == StateInProgress {
+		if binding.Operation == OperationBind && async {
+			r.JSON(202, AsyncResponse{OperationBind})
+			return
+		}
+		r.JSON(422, ErrorResponse{"ConcurrencyError", "Another operation is in progress on the binding"})
+		return
+	}
+
+	if binding.Id > 0 && binding.Operation == OperationBind && binding.State != StateFailed {
+		respondWithCredentials(200, &instance, &binding, hosts, s, r, l)
+		return
+	}
+
+	if binding.Id == 0 {
+		binding = requested
+		binding.Uuid = p["id"]
+		binding.InstanceUuid = instance.Uuid
+	} else {
+		// A retry makes the binding the new request asked for
+		binding.Parameters = requested.Parameters
+		binding.Kind = requested.Kind
+		binding.AppGuid = requested.AppGuid
+		binding.ValidUntil = requested.ValidUntil
+	}
+
+	err := RunBindingOperation(db, jobs, &binding, OperationBind, async, l, func() error {
+		if binding.NeedsRole() {
+			if err := CreateBindingRole(&instance, &binding, hosts, s, l); err != nil {
+				return err
+			}
+		} else if binding.Username != "" {
+			// The failed attempt was for a binding with a role of its own
+			if err := DropBindingRole(&instance, &binding, hosts, s, l); err != nil {
+				l.Error("Error dropping the role of the failed bind", err)
+			}
+			binding.Username = ""
+			binding.Password = ""
+			binding.LoginRole = ""
+			binding.RetiringRole = ""
+		}
+		_, err := Credentials(&instance, &binding, hosts, s)
+		return err
+	})
+	if err != nil {
+		r.JSON(500, Response{"There was an error creating the binding"})
+		return
+	}
+
+	if async {
+		r.JSON(202, AsyncResponse{OperationBind})
+		return
+	}
+	respondWithCredentials(201, &instance, &binding, hosts, s, r, l)
+}
+
+func respondWithCredentials(status int, instance *Instance, binding *Binding, hosts *HostRegistry, s *Settings, r render.Render, l *Logger) {
+	credentials, err := Credentials(instance, binding, hosts, s)
+	if err != nil {
+		l.Error("Error building the credentials", err)
+		r.JSON(500, Response{"There was an error building the credentials"})
+		return
+	}
+
+	response := map[string]interface{}{
+		"credentials": credentials,
+	}
+	r.JSON(status, response)
+}
+
+// GetBinding
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
+func GetBinding(p martini.Params, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, l *Logger) {
+	binding := Binding{}
+	db.Where("uuid = ? AND instance_uuid = ?", p["id"], p["instance_id"]).First(&binding)
+	if binding.Id == 0 || (binding.State != StateSucceeded && binding.State != "") {
+		r.JSON(404, Response{"Binding not found"})
+		return
+	}
+
+	instance := Instance{}
+	db.Where("uuid = ?", binding.InstanceUuid).First(&instance)
+	if instance.Id == 0 {
+		r.JSON(404, Response{"Instance not found"})
+		return
+	}
+
+	credentials, err := Credentials(&instance, &binding, hosts, s)
+	if err != nil {
+		l.Error("Error building the credentials", err)
+		r.JSON(500, Response{"There was an error building the credentials"})
+		return
+	}
+
+	response := bindingResponse{Credentials: credentials}
+	if binding.Parameters != "" {
+		response.Parameters = json.RawMessage(binding.Parameters)
+	}
+	r.JSON(200, response)
+}
+
+// UnbindInstance
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
+// With accepts_incomplete=true the binding is removed in the background.
+func UnbindInstance(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, jobs *Jobs, s *Settings, l *Logger) {
+	var emptyJson struct{}
+
+	binding := Binding{}
+	db.Where("uuid = ? AND instance_uuid = ?", p["id"], p["instance_id"]).First(&binding)
+	if binding.Id == 0 {
+		r.JSON(200, emptyJson)
+		return
+	}
+
+	async := req.URL.Query().Get("accepts_incomplete") == "true"
+	if binding.State == StateInProgress {
+		if binding.Operation == OperationUnbind && async {
+			r.JSON(202, AsyncResponse{OperationUnbind})
+			return
+		}
+		r.JSON(422, ErrorResponse{"ConcurrencyError", "Another operation is in progress on the binding"})
+		return
+	}
+
+	err := RunBindingOperation(db, jobs, &binding, OperationUnbind, async, l, func() error {
+		if binding.Username == "" {
+			return nil
+		}
+
+		instance := Instance{}
+		db.Where("uuid = ?", binding.InstanceUuid).First(&instance)
+		if instance.Id == 0 {
+			return nil
+		}
+		return DropBindingRole(&instance, &binding, hosts, s, l)
+	})
+	if err != nil {
+		r.JSON(500, Response{"There was an error deleting the binding"})
+		return
+	}
+
+	if async {
+		r.JSON(202, AsyncResponse{OperationUnbind})
+		return
+	}
+	r.JSON(200, emptyJson)
+}
+
+// BindingLastOperation
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation
+// A binding that is gone returns 410, which tells the platform the unbind
+// succeeded.
+func BindingLastOperation(p martini.Params, r render.Render, db *gorm.DB) {
+	binding := Binding{}
+	db.Where("uuid = ? AND instance_uuid = ?", p["id"], p["instance_id"]).First(&binding)
+	if binding.Id == 0 {
+		var emptyJson struct{}
+		r.JSON(410, emptyJson)
+		return
+	}
+
+	state := binding.State
+	if state == "" {
+		state = StateSucceeded
+	}
+
+	operation := Operation{State: state, Description: binding.Description}
+	if state == StateInProgress {
+		operation.AsyncPollIntervalSeconds = asyncPollInterval
+	}
+	r.JSON(200, operation)
+}
+
+// The sslmode apps are told to connect with
+const BindingSslmode = "verify-full"
+
+// Credentials returns what apps need to connect to the instance database,
+// along with the optional fields its plan includes. Read-only bindings get
+// the credentials of their own role.
+func Credentials(instance *Instance, binding *Binding, hosts *HostRegistry, s *Settings) (map[string]string, error) {
+	host, err := hosts.HostFor(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	username := instance.LoginUsername()
 	password, err := instance.GetPassword(s.EncryptionKey)
+	if binding != nil && binding.Username != "" {
+		username = binding.LoginUsername()
+		password, err = binding.GetPassword(s.EncryptionKey)
+	}
 	if err != nil {
-		r.JSON(500, "")
+		return nil, err
+	}
+
+	plan := FindPlan(instance.PlanId)
+	if plan == nil {
+		plan = &Plan{}
 	}
 
 	uri := fmt.Sprintf("postgres://%s:%s@%s:%s/%s",
-		instance.Username,
+		username,
 		password,
-		s.Rds.Url,
-		s.Rds.Port,
+		host.Rds.Url,
+		host.Rds.Port,
 		instance.Database)
+	if plan.Includes(CredentialSslmode) {
+		uri += "?sslmode=" + BindingSslmode
+	}
 
 	credentials := map[string]string{
 		"uri":      uri,
-		"username": instance.Username,
+		"username": username,
 		"password": password,
-		"host":     s.Rds.Url,
+		"host":     host.Rds.Url,
 		"db_name":  instance.Database,
 	}
 
-	response := map[string]interface{}{
-		"credentials": credentials,
+	if binding != nil && !binding.ValidUntil.IsZero() {
+		credentials["valid_until"] = binding.ValidUntil.Format(time.RFC3339)
 	}
-	r.JSON(201, response)
+
+	if plan.Includes(CredentialPort) {
+		credentials["port"] = host.Rds.Port
+	}
+	if plan.Includes(CredentialSslmode) {
+		credentials["sslmode"] = BindingSslmode
+	}
+	if plan.Includes(CredentialCACertificate) && s.CACertificate != "" {
+		credentials["ca_certificate"] = s.CACertificate
+	}
+	if plan.Includes(CredentialJdbcUrl) {
+		jdbc := url.Values{}
+		jdbc.Set("user", username)
+		jdbc.Set("password", password)
+		if plan.Includes(CredentialSslmode) {
+			jdbc.Set("ssl", "true")
+			jdbc.Set("sslmode", BindingSslmode)
+		}
+		credentials["jdbcUrl"] = fmt.Sprintf("jdbc:postgresql://%s:%s/%s?%s",
+			host.Rds.Url,
+			host.Rds.Port,
+			instance.Database,
+			jdbc.Encode())
+	}
+
+	return credentials, nil
 }
 
 // DeleteInstance
@@ -116,7 +524,7 @@ func BindInstance(p martini.Params, r render.Render, db *gorm.DB, s *Settings) {
 //   "service_id": "service-id-here"
 //   "plan_id":    "plan-id-here"
 // }
-func DeleteInstance(p martini.Params, r render.Render, db *gorm.DB) {
+func DeleteInstance(p martini.Params, r render.Render, db *gorm.DB, hosts *HostRegistry, l *Logger) {
 	instance := Instance{}
 
 	db.Where("uuid = ?", p["id"]).First(&instance)
@@ -126,10 +534,52 @@ func DeleteInstance(p martini.Params, r render.Render, db *gorm.DB) {
 		return
 	}
 
-	db.Exec(fmt.Sprintf("DROP DATABASE %s;", instance.Database))
-	db.Exec(fmt.Sprintf("DROP USER %s;", instance.Username))
-
-	db.Delete(&instance)
+	if err := Deprovision(db, hosts, &instance, l); err != nil {
+		r.JSON(500, Response{err.Error()})
+		return
+	}
 
 	r.JSON(200, Response{"The instance was deleted"})
 }
+
+// Deprovision drops the database and the roles of the instance and forgets
+// it along with its bindings
+func Deprovision(db *gorm.DB, hosts *HostRegistry, instance *Instance, l *Logger) error {
+	host, err := hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+
+	op := StartOperation(db, OperationDeprovision, instance)
+	defer op.Finish(db)
+
+	// The roles of read-only bindings lost their grants with the database
+	var bindings []Binding
+	db.Where("instance_uuid = ? AND username <> ''", instance.Uuid).Find(&bindings)
+
+	// Everything is dropped IF EXISTS, so a deprovision that failed halfway
+	// can be retried. Until then the instance and its bindings are kept.
+	statements := []string{
+		fmt.Sprintf("DROP DATABASE IF EXISTS %s;", instance.Database),
+		fmt.Sprintf("DROP USER IF EXISTS %s;", TwinRole(instance.Username)),
+		fmt.Sprintf("DROP USER IF EXISTS %s;", instance.Username),
+	}
+	for _, binding := range bindings {
+		statements = append(statements,
+			fmt.Sprintf("DROP USER IF EXISTS %s;", TwinRole(binding.Username)),
+			fmt.Sprintf("DROP USER IF EXISTS %s;", binding.Username))
+	}
+	if err := execAllWith(hostExec, host.DB, l, statements); err != nil {
+		return fmt.Errorf("There was an error dropping the instance: %s", err)
+	}
+
+	if err := db.Where("instance_uuid = ?", instance.Uuid).Delete(Binding{}).Error; err != nil {
+		return err
+	}
+	if err := db.Delete(instance).Error; err != nil {
+		return err
+	}
+	l.Info("Deleted instance", "host", host.Name)
+
+	return nil
+}
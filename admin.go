@@ -0,0 +1,449 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+	"github.com/martini-contrib/render"
+
+	"crypto/aes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type quotaReq struct {
+	Limit *int64 `json:"limit"`
+}
+
+type quotaResponse struct {
+	Scope string `json:"scope"`
+	Guid  string `json:"guid"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used,omitempty"`
+}
+
+// ListQuotas
+// URL: /admin/quotas
+func ListQuotas(r render.Render, db *gorm.DB) {
+	var quotas []Quota
+	db.Order("scope, guid").Find(&quotas)
+
+	response := []quotaResponse{}
+	for _, q := range quotas {
+		response = append(response, quotaResponse{Scope: q.Scope, Guid: q.Guid, Limit: q.Limit})
+	}
+
+	r.JSON(200, map[string]interface{}{"quotas": response})
+}
+
+// ShowQuota
+// URL: /admin/quotas/:scope/:guid
+// Returns the quota in effect for the org, space or plan and how much of it
+// is in use.
+func ShowQuota(p martini.Params, r render.Render, db *gorm.DB) {
+	scope := p["scope"]
+	if !ValidQuotaScope(scope) {
+		r.JSON(404, Response{"Unknown quota scope"})
+		return
+	}
+
+	response := quotaResponse{Scope: scope, Guid: p["guid"], Limit: QuotaUnlimited}
+	if quota := FindQuota(db, scope, p["guid"]); quota != nil {
+		response.Limit = quota.Limit
+	}
+	response.Used = QuotaUsage(db, scope, p["guid"])
+
+	r.JSON(200, response)
+}
+
+// SetQuota
+// URL: /admin/quotas/:scope or /admin/quotas/:scope/:guid
+// Request:
+// {
+//   "limit": 10
+// }
+// Without a guid it sets the default for the scope.
+func SetQuota(p martini.Params, req *http.Request, r render.Render, db *gorm.DB) {
+	scope := p["scope"]
+	if !ValidQuotaScope(scope) {
+		r.JSON(404, Response{"Unknown quota scope"})
+		return
+	}
+
+	var qr quotaReq
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &qr)
+	}
+	if qr.Limit == nil {
+		r.JSON(400, Response{"A limit is required"})
+		return
+	}
+
+	quota := Quota{}
+	db.Where("scope = ? AND guid = ?", scope, p["guid"]).First(&quota)
+	quota.Scope = scope
+	quota.Guid = p["guid"]
+	quota.Limit = *qr.Limit
+
+	if err := db.Save(&quota).Error; err != nil {
+		r.JSON(500, Response{"There was an error saving the quota"})
+		return
+	}
+
+	r.JSON(200, quotaResponse{Scope: quota.Scope, Guid: quota.Guid, Limit: quota.Limit})
+}
+
+// DeleteQuota
+// URL: /admin/quotas/:scope or /admin/quotas/:scope/:guid
+func DeleteQuota(p martini.Params, r render.Render, db *gorm.DB) {
+	quota := Quota{}
+	db.Where("scope = ? AND guid = ?", p["scope"], p["guid"]).First(&quota)
+	if quota.Id == 0 {
+		r.JSON(404, Response{"Quota not found"})
+		return
+	}
+
+	db.Delete(&quota)
+
+	r.JSON(200, Response{"The quota was deleted"})
+}
+
+type hostReq struct {
+	Name     string    `json:"name"`
+	Url      string    `json:"url"`
+	Port     string    `json:"port"`
+	DbName   string    `json:"db_name"`
+	Username string    `json:"username"`
+	Password *string   `json:"password"`
+	Sslmode  string    `json:"sslmode"`
+	Plans    *[]string `json:"plans"`
+	Draining *bool     `json:"draining"`
+
+	SslRootCert   string `json:"sslrootcert"`
+	SslCert       string `json:"sslcert"`
+	SslKey        string `json:"sslkey"`
+	SslServerName string `json:"ssl_server_name"`
+}
+
+type hostResponse struct {
+	Name      string   `json:"name"`
+	Url       string   `json:"url"`
+	Port      string   `json:"port"`
+	DbName    string   `json:"db_name"`
+	Username  string   `json:"username"`
+	Sslmode   string   `json:"sslmode"`
+	Plans     []string `json:"plans"`
+	Draining  bool     `json:"draining"`
+	Instances int64    `json:"instances"`
+	Bytes     *int64   `json:"bytes,omitempty"`
+
+	SslRootCert   string `json:"sslrootcert,omitempty"`
+	SslCert       string `json:"sslcert,omitempty"`
+	SslServerName string `json:"ssl_server_name,omitempty"`
+}
+
+func newHostResponse(host *Host, hosts *HostRegistry, db *gorm.DB) hostResponse {
+	response := hostResponse{
+		Name:      host.Name,
+		Url:       host.Url,
+		Port:      host.Port,
+		DbName:    host.DbName,
+		Username:  host.Username,
+		Sslmode:   host.Sslmode,
+		Plans:     host.PlanIds(),
+		Draining:  host.Draining,
+		Instances: HostInstanceCount(db, host.Name),
+
+		SslRootCert:   host.SslRootCert,
+		SslCert:       host.SslCert,
+		SslServerName: host.SslServerName,
+	}
+
+	if bh := hosts.Get(host.Name); bh != nil {
+		if size, err := bh.Size(); err == nil {
+			response.Bytes = &size
+		}
+	}
+
+	return response
+}
+
+// ListHosts
+// URL: /admin/hosts
+// Returns every host with the number of instances and bytes it holds.
+func ListHosts(r render.Render, db *gorm.DB, hosts *HostRegistry) {
+	var list []Host
+	db.Order("name").Find(&list)
+
+	response := []hostResponse{}
+	for i := range list {
+		response = append(response, newHostResponse(&list[i], hosts, db))
+	}
+
+	r.JSON(200, map[string]interface{}{"hosts": response})
+}
+
+// CreateHost
+// URL: /admin/hosts
+// Request:
+// {
+//   "name":     "shared2",
+//   "url":      "10.0.0.2",
+//   "port":     "5432",
+//   "db_name":  "postgres",
+//   "username": "rds",
+//   "password": "secret",
+//   "sslmode":  "verify-ca",
+//   "plans":    ["plan-guid-here"]
+// }
+// The optional "sslrootcert", "sslcert" and "sslkey" are paths on the
+// broker, and "ssl_server_name" is the name in the host certificate when
+// it isn't the url. The sslmode and sslrootcert of the broker DB are used
+// when they are not given.
+func CreateHost(req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings) {
+	var hr hostReq
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &hr)
+	}
+
+	if hr.Name == "" || hr.Url == "" {
+		r.JSON(400, Response{"A name and an url are required"})
+		return
+	}
+
+	host := Host{}
+	db.Where("name = ?", hr.Name).First(&host)
+	if host.Id > 0 {
+		r.JSON(409, Response{"The host already exists"})
+		return
+	}
+
+	host.Name = hr.Name
+	host.Port = "5432"
+	defaults := s.HostDefaults()
+	host.Sslmode = defaults.Sslmode
+	host.SslRootCert = defaults.SslRootCert
+	host.Salt = GenerateSalt(aes.BlockSize)
+	saveHost(&host, &hr, r, db, hosts, s, 201)
+}
+
+// UpdateHost
+// URL: /admin/hosts/:name
+// Request: the fields of CreateHost to change, and "draining"
+func UpdateHost(p martini.Params, req *http.Request, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings) {
+	host := Host{}
+	db.Where("name = ?", p["name"]).First(&host)
+	if host.Id == 0 {
+		r.JSON(404, Response{"Host not found"})
+		return
+	}
+
+	var hr hostReq
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &hr)
+	}
+
+	saveHost(&host, &hr, r, db, hosts, s, 200)
+}
+
+// saveHost applies a create or update request to host, checks that the
+// broker can connect to it and saves it. The registry only gets the host
+// once it is saved.
+func saveHost(host *Host, hr *hostReq, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, status int) {
+	if hr.Url != "" {
+		host.Url = hr.Url
+	}
+	if hr.Port != "" {
+		host.Port = hr.Port
+	}
+	if hr.DbName != "" {
+		host.DbName = hr.DbName
+	}
+	if hr.Username != "" {
+		host.Username = hr.Username
+	}
+	if hr.Sslmode != "" {
+		host.Sslmode = hr.Sslmode
+	}
+	if hr.SslRootCert != "" {
+		host.SslRootCert = hr.SslRootCert
+	}
+	if hr.SslCert != "" {
+		host.SslCert = hr.SslCert
+	}
+	if hr.SslKey != "" {
+		host.SslKey = hr.SslKey
+	}
+	if hr.SslServerName != "" {
+		host.SslServerName = hr.SslServerName
+	}
+	if hr.Plans != nil {
+		host.Plans = strings.Join(*hr.Plans, ",")
+	}
+	if hr.Draining != nil {
+		host.Draining = *hr.Draining
+	}
+	if hr.Password != nil {
+		if err := host.SetPassword(*hr.Password, s.EncryptionKey); err != nil {
+			r.JSON(500, Response{"There was an error setting the password" + err.Error()})
+			return
+		}
+	}
+
+	backing, err := hosts.Dial(host, s.EncryptionKey)
+	if err != nil {
+		r.JSON(422, Response{err.Error()})
+		return
+	}
+
+	if err := db.Save(host).Error; err != nil {
+		backing.DB.Close()
+		r.JSON(500, Response{"There was an error saving the host"})
+		return
+	}
+	hosts.Add(backing)
+
+	r.JSON(status, newHostResponse(host, hosts, db))
+}
+
+// DrainHost
+// URL: /admin/hosts/:name/drain
+// The host keeps its instances but new ones are placed elsewhere.
+func DrainHost(p martini.Params, r render.Render, db *gorm.DB, hosts *HostRegistry) {
+	host := Host{}
+	db.Where("name = ?", p["name"]).First(&host)
+	if host.Id == 0 {
+		r.JSON(404, Response{"Host not found"})
+		return
+	}
+
+	host.Draining = true
+	if err := db.Save(&host).Error; err != nil {
+		r.JSON(500, Response{"There was an error saving the host"})
+		return
+	}
+	hosts.SetDraining(host.Name, true)
+
+	r.JSON(200, newHostResponse(&host, hosts, db))
+}
+
+// DeleteHost
+// URL: /admin/hosts/:name
+// Hosts that still have instances can't be deleted.
+func DeleteHost(p martini.Params, r render.Render, db *gorm.DB, hosts *HostRegistry) {
+	host := Host{}
+	db.Where("name = ?", p["name"]).First(&host)
+	if host.Id == 0 {
+		r.JSON(404, Response{"Host not found"})
+		return
+	}
+
+	if count := HostInstanceCount(db, host.Name); count > 0 {
+		r.JSON(409, Response{fmt.Sprintf("The host still has %d instances", count)})
+		return
+	}
+
+	db.Delete(&host)
+	hosts.Remove(host.Name)
+
+	r.JSON(200, Response{"The host was deleted"})
+}
+
+type serviceKeyResponse struct {
+	BindingId  string     `json:"binding_id"`
+	Username   string     `json:"username"`
+	ReadOnly   bool       `json:"read_only"`
+	State      string     `json:"state"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	Expired    bool       `json:"expired"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ListServiceKeys
+// URL: /admin/service_keys
+// Returns the service keys by instance. The instance_id query parameter
+// limits the list to one instance.
+func ListServiceKeys(req *http.Request, r render.Render, db *gorm.DB) {
+	query := db.Where("kind = ?", BindingServiceKey)
+	if id := req.URL.Query().Get("instance_id"); id != "" {
+		query = query.Where("instance_uuid = ?", id)
+	}
+
+	var keys []Binding
+	query.Order("instance_uuid, created_at").Find(&keys)
+
+	response := map[string][]serviceKeyResponse{}
+	for i := range keys {
+		key := &keys[i]
+		item := serviceKeyResponse{
+			BindingId: key.Uuid,
+			Username:  key.Username,
+			ReadOnly:  key.ReadOnly(),
+			State:     key.State,
+			CreatedAt: key.CreatedAt,
+		}
+		if !key.ValidUntil.IsZero() {
+			item.ValidUntil = &key.ValidUntil
+			item.Expired = key.ValidUntil.Before(time.Now())
+		}
+		response[key.InstanceUuid] = append(response[key.InstanceUuid], item)
+	}
+
+	r.JSON(200, map[string]interface{}{"service_keys": response})
+}
+
+type rotationResponse struct {
+	BindingId    string    `json:"binding_id,omitempty"`
+	LoginRole    string    `json:"login_role"`
+	RetiringRole string    `json:"retiring_role"`
+	RetireAt     time.Time `json:"retire_at"`
+}
+
+// RotateCredentials
+// URL: /admin/instances/:id/rotate
+// Rotates the password of the instance and of its bindings with their own
+// role. The previous credentials keep working for the rotation overlap.
+func RotateCredentials(p martini.Params, r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, l *Logger) {
+	instance := Instance{}
+	db.Where("uuid = ?", p["id"]).First(&instance)
+	if instance.Id == 0 {
+		r.JSON(404, Response{"Instance not found"})
+		return
+	}
+
+	err := NewCredentialRotator(db, hosts, s).RotateInstance(&instance)
+	if err == ErrRotationInProgress {
+		r.JSON(409, Response{err.Error()})
+		return
+	}
+	if err != nil {
+		l.Error("Error rotating the credentials", err)
+		r.JSON(500, Response{"There was an error rotating the credentials"})
+		return
+	}
+
+	response := []rotationResponse{{
+		LoginRole:    instance.LoginRole,
+		RetiringRole: instance.RetiringRole,
+		RetireAt:     instance.RetireAt,
+	}}
+
+	var bindings []Binding
+	db.Where("instance_uuid = ? AND username <> ''", instance.Uuid).Order("id").Find(&bindings)
+	for _, binding := range bindings {
+		response = append(response, rotationResponse{
+			BindingId:    binding.Uuid,
+			LoginRole:    binding.LoginRole,
+			RetiringRole: binding.RetiringRole,
+			RetireAt:     binding.RetireAt,
+		})
+	}
+
+	r.JSON(200, map[string]interface{}{"rotated": response})
+}
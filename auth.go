@@ -0,0 +1,313 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/auth"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The roles a credential can have
+const (
+	RolePlatform = "platform"
+	RoleAdmin    = "admin"
+	RoleReadOnly = "read-only"
+
+	// The AUTH_USER and METRICS_USER pairs, from before roles
+	roleBroker  = "broker"
+	roleMetrics = "metrics"
+)
+
+// Permission is what a route needs
+type Permission int
+
+const (
+	// The service broker API
+	PermBroker Permission = iota
+	// Changes through the admin API
+	PermAdmin
+	// Reads through the admin API
+	PermAdminRead
+	PermMetrics
+)
+
+var rolePermissions = map[string][]Permission{
+	RolePlatform: {PermBroker},
+	RoleAdmin:    {PermAdmin, PermAdminRead, PermMetrics},
+	RoleReadOnly: {PermAdminRead, PermMetrics},
+	roleBroker:   {PermBroker, PermAdmin, PermAdminRead},
+	roleMetrics:  {PermMetrics},
+}
+
+// ValidRole tells if role can be given to a credential in the config
+func ValidRole(role string) bool {
+	return role == RolePlatform || role == RoleAdmin || role == RoleReadOnly
+}
+
+// Credential is a username and the bcrypt hash of its password. Several
+// credentials can share a username, so a password can be rotated by adding
+// the new one before removing the old one.
+type Credential struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+	Role         string `yaml:"role"`
+}
+
+func (c *Credential) Allows(perm Permission) bool {
+	for _, p := range rolePermissions[c.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns what is wrong with the credential, if anything
+func (c *Credential) Check() error {
+	if c.Username == "" {
+		return fmt.Errorf("A credential needs a username")
+	}
+	if !ValidRole(c.Role) {
+		return fmt.Errorf("The role %q of %s is not platform, admin or read-only", c.Role, c.Username)
+	}
+	if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+		return fmt.Errorf("The password_hash of %s is not a bcrypt hash: %s", c.Username, err)
+	}
+	return nil
+}
+
+// LoadCredentialsFile reads and checks the credentials in a YAML file, in
+// the layout of auth.credentials:
+//
+//	credentials:
+//	- username: cf
+//	  password_hash: $2a$10$...
+//	  role: platform
+func LoadCredentialsFile(path string) ([]Credential, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Credentials []Credential `yaml:"credentials"`
+	}
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+
+	for i := range file.Credentials {
+		if err := file.Credentials[i].Check(); err != nil {
+			return nil, err
+		}
+	}
+	return file.Credentials, nil
+}
+
+// Authenticator checks the credentials of the requests. The credentials
+// file is read again when it changes, so credentials can be added and
+// removed without a restart.
+type Authenticator struct {
+	static []Credential
+	file   string
+	// Checks the bearer tokens on the admin API, when there is an issuer
+	jwt *JWTVerifier
+
+	mu       sync.Mutex
+	fromFile []Credential
+	modified time.Time
+	// The credentials already checked, by a digest of username and
+	// password, as bcrypt is slow on purpose
+	verified map[[sha256.Size]byte][]*Credential
+}
+
+func NewAuthenticator(as AuthSettings) (*Authenticator, error) {
+	a := &Authenticator{static: as.Credentials, file: as.CredentialsFile}
+	if as.JWT.JWKSURL != "" {
+		a.jwt = NewJWTVerifier(as.JWT)
+	}
+
+	legacy := []struct{ username, password, role string }{
+		{as.Username, as.Password, roleBroker},
+		{as.MetricsUsername, as.MetricsPassword, roleMetrics},
+	}
+	for _, l := range legacy {
+		if l.username == "" {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(l.password), bcrypt.MinCost)
+		if err != nil {
+			return nil, err
+		}
+		a.static = append(a.static, Credential{Username: l.username, PasswordHash: string(hash), Role: l.role})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload reads the credentials file if it changed. A file that can't be
+// read keeps the previous credentials.
+func (a *Authenticator) reload() error {
+	if a.verified == nil {
+		a.verified = map[[sha256.Size]byte][]*Credential{}
+	}
+	if a.file == "" {
+		return nil
+	}
+
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modified) {
+		return nil
+	}
+
+	credentials, err := LoadCredentialsFile(a.file)
+	if err != nil {
+		return fmt.Errorf("Error reading the credentials file %s: %s", a.file, err)
+	}
+	a.fromFile = credentials
+	a.modified = info.ModTime()
+	a.verified = map[[sha256.Size]byte][]*Credential{}
+	Log.Info("Loaded the credentials", "file", a.file, "count", len(credentials))
+	return nil
+}
+
+// Authenticate returns the credentials matching username and password
+func (a *Authenticator) Authenticate(username, password string) []*Credential {
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+
+	a.mu.Lock()
+	if err := a.reload(); err != nil {
+		Log.Error("Error reloading the credentials", err)
+	}
+	if matches, ok := a.verified[digest]; ok {
+		a.mu.Unlock()
+		return matches
+	}
+	verified := a.verified
+	lists := [][]Credential{a.static, a.fromFile}
+	a.mu.Unlock()
+
+	// Without the lock, other requests don't wait for bcrypt
+	matches := []*Credential{}
+	for _, list := range lists {
+		for i := range list {
+			if list[i].Username == username && bcrypt.CompareHashAndPassword([]byte(list[i].PasswordHash), []byte(password)) == nil {
+				matches = append(matches, &list[i])
+			}
+		}
+	}
+
+	if len(matches) > 0 {
+		a.mu.Lock()
+		verified[digest] = matches
+		a.mu.Unlock()
+	}
+	return matches
+}
+
+// Allows tells if any credential can have perm
+func (a *Authenticator) Allows(perm Permission) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != "" {
+		return true
+	}
+	for i := range a.static {
+		if a.static[i].Allows(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Require only lets the requests through with basic auth credentials that
+// have perm
+func (a *Authenticator) Require(perm Permission) martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		a.check(perm, res, req, c)
+	}
+}
+
+// Identify maps the username of basic auth credentials that have perm, and
+// an empty one for everybody else, without turning anyone away
+func (a *Authenticator) Identify(perm Permission) martini.Handler {
+	return func(req *http.Request, c martini.Context) {
+		username, password, ok := req.BasicAuth()
+		if ok {
+			for _, credential := range a.Authenticate(username, password) {
+				if credential.Allows(perm) {
+					c.Map(auth.User(username))
+					return
+				}
+			}
+		}
+		c.Map(auth.User(""))
+	}
+}
+
+// RequireAdmin is Require for the admin API, where reads only need
+// PermAdminRead. Bearer tokens are accepted too when there is an issuer.
+func (a *Authenticator) RequireAdmin() martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		perm := PermAdmin
+		if req.Method == "GET" || req.Method == "HEAD" {
+			perm = PermAdminRead
+		}
+
+		header := req.Header.Get("Authorization")
+		if a.jwt != nil && strings.HasPrefix(header, "Bearer ") {
+			a.jwt.checkBearer(strings.TrimPrefix(header, "Bearer "), perm, res, c)
+			return
+		}
+		a.check(perm, res, req, c)
+	}
+}
+
+func (a *Authenticator) check(perm Permission, res http.ResponseWriter, req *http.Request, c martini.Context) {
+	username, password, _ := req.BasicAuth()
+
+	// Credentials without perm get the same answer as wrong ones, like
+	// when every route had its own pair
+	for _, credential := range a.Authenticate(username, password) {
+		if credential.Allows(perm) {
+			c.Map(auth.User(username))
+			return
+		}
+	}
+	unauthorized(res)
+}
+
+func unauthorized(res http.ResponseWriter) {
+	res.Header().Set("WWW-Authenticate", `Basic realm="`+auth.BasicRealm+`"`)
+	http.Error(res, "Not Authorized", http.StatusUnauthorized)
+}
+
+// BrokerAuth returns the handlers that authenticate the platform on the
+// service broker API
+func BrokerAuth(s *Settings, a *Authenticator) []martini.Handler {
+	switch s.ServerTLS.ClientAuth {
+	case ClientAuthCertificate:
+		return []martini.Handler{ClientCertAuth(s.ServerTLS.ClientNames)}
+	case ClientAuthBoth:
+		return []martini.Handler{ClientCertAuth(s.ServerTLS.ClientNames), a.Require(PermBroker)}
+	}
+	return []martini.Handler{a.Require(PermBroker)}
+}
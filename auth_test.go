@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"golang.org/x/crypto/bcrypt"
+
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// requestAs returns the status of a request with the basic auth of
+// username and password
+func requestAs(m *martini.ClassicMartini, method, url, username, password string, body io.Reader) int {
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, body)
+	req.SetBasicAuth(username, password)
+	m.ServeHTTP(res, req)
+	return res.Code
+}
+
+func TestCredentialRoles(t *testing.T) {
+	s := testSettings()
+	s.Auth.Credentials = []Credential{
+		{Username: "cf", PasswordHash: hashPassword(t, "cf-pass"), Role: RolePlatform},
+		{Username: "ops", PasswordHash: hashPassword(t, "ops-pass"), Role: RoleAdmin},
+		{Username: "viewer", PasswordHash: hashPassword(t, "viewer-pass"), Role: RoleReadOnly},
+	}
+	m, err := App(s, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		method, url, username, password string
+		code                            int
+	}{
+		{"GET", "/v2/catalog", "cf", "cf-pass", 200},
+		{"GET", "/v2/catalog", "cf", "wrong", 401},
+		{"GET", "/admin/quotas", "cf", "cf-pass", 401},
+		{"GET", "/metrics", "cf", "cf-pass", 401},
+		{"GET", "/v2/catalog", "ops", "ops-pass", 401},
+		{"GET", "/admin/quotas", "ops", "ops-pass", 200},
+		{"PUT", "/admin/quotas/org", "ops", "ops-pass", 200},
+		{"GET", "/metrics", "ops", "ops-pass", 200},
+		{"GET", "/admin/quotas", "viewer", "viewer-pass", 200},
+		{"PUT", "/admin/quotas/org", "viewer", "viewer-pass", 401},
+		{"GET", "/metrics", "viewer", "viewer-pass", 200},
+		// The plaintext pair from before roles
+		{"GET", "/v2/catalog", "default", "default", 200},
+		{"PUT", "/admin/quotas/org", "default", "default", 200},
+	}
+	for _, c := range checks {
+		if code := requestAs(m, c.method, c.url, c.username, c.password, strings.NewReader(`{"limit": 5}`)); code != c.code {
+			t.Error(c.method, c.url, "as", c.username, "should return", c.code, "and it returned", code)
+		}
+	}
+}
+
+func TestCredentialsFileReload(t *testing.T) {
+	write := func(path string, credentials ...string) {
+		content := "credentials:\n"
+		for _, password := range credentials {
+			content += "- username: cf\n  password_hash: " + hashPassword(t, password) + "\n  role: platform\n"
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Each write is seen as a change even within the mtime resolution
+		later := time.Now().Add(time.Duration(len(credentials)) * time.Minute)
+		os.Chtimes(path, later, later)
+	}
+
+	path := writeFile(t, "credentials.yml", "")
+	write(path, "old")
+
+	a, err := NewAuthenticator(AuthSettings{CredentialsFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Authenticate("cf", "old")) != 1 {
+		t.Error("The credentials in the file should be accepted")
+	}
+
+	// The new password is added before the platform switches to it
+	write(path, "old", "new")
+	if len(a.Authenticate("cf", "old")) != 1 || len(a.Authenticate("cf", "new")) != 1 {
+		t.Error("Both passwords should be accepted during the rotation")
+	}
+
+	// Then the old one is removed
+	write(path, "new", "new", "new")
+	if len(a.Authenticate("cf", "old")) != 0 {
+		t.Error("The removed password should be rejected")
+	}
+
+	// A broken file keeps the credentials
+	ioutil.WriteFile(path, []byte("credentials: [{username: cf, role: nobody}]"), 0600)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	if len(a.Authenticate("cf", "new")) == 0 {
+		t.Error("A broken credentials file should leave the previous credentials in place")
+	}
+}
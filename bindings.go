@@ -0,0 +1,395 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"crypto/aes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The states of an operation, as the platform expects them
+const (
+	StateInProgress = "in progress"
+	StateSucceeded  = "succeeded"
+	StateFailed     = "failed"
+)
+
+const (
+	OperationBind   = "bind"
+	OperationUnbind = "unbind"
+)
+
+// What a binding is for
+const (
+	BindingApp        = "app"
+	BindingServiceKey = "service_key"
+)
+
+// How often the platform should poll async operations
+const asyncPollInterval = 5
+
+// How often the binding operations that went stale are failed
+var StaleBindingsInterval = time.Minute
+
+// The bindings whose operation runs in this process, which shutdown fails
+// when it can't wait for them
+var runningBindings = struct {
+	sync.Mutex
+	ids map[int64]bool
+}{ids: map[int64]bool{}}
+
+// RunBindingOperation records that operation started on binding and runs
+// work, in the background when async. Once work is done the binding gets
+// the outcome, or is deleted after a successful unbind.
+func RunBindingOperation(db *gorm.DB, jobs *Jobs, binding *Binding, operation string, async bool, l *Logger, work func() error) error {
+	binding.Operation = operation
+	binding.State = StateInProgress
+	binding.Description = ""
+	if err := db.Save(binding).Error; err != nil {
+		return err
+	}
+
+	runningBindings.Lock()
+	runningBindings.ids[binding.Id] = true
+	runningBindings.Unlock()
+
+	finish := func() error {
+		defer func() {
+			runningBindings.Lock()
+			delete(runningBindings.ids, binding.Id)
+			runningBindings.Unlock()
+		}()
+
+		err := work()
+		if err != nil {
+			l.Error("The binding operation failed", err, "operation", operation)
+			binding.State = StateFailed
+			binding.Description = Redact(err.Error())
+			db.Save(binding)
+			return err
+		}
+
+		if operation == OperationUnbind {
+			db.Delete(binding)
+		} else {
+			binding.State = StateSucceeded
+			db.Save(binding)
+		}
+		l.Info("The binding operation succeeded", "operation", operation)
+		return nil
+	}
+
+	if !async {
+		return finish()
+	}
+
+	jobs.Go(func(<-chan struct{}) {
+		finish()
+	})
+	return nil
+}
+
+// The binding operations that stopped with the broker get this description
+var stoppedBindingColumns = map[string]interface{}{
+	"state":       StateFailed,
+	"description": "The broker stopped during the operation",
+}
+
+// FailStaleBindings marks the binding operations that stopped with the
+// broker as failed, so the platform stops polling them
+func FailStaleBindings(db *gorm.DB) {
+	db.Model(Binding{}).
+		Where("state = ? AND updated_at < ?", StateInProgress, time.Now().Add(-StaleOperationAge)).
+		UpdateColumns(stoppedBindingColumns)
+}
+
+// SweepStaleBindings fails the stale binding operations every
+// StaleBindingsInterval until stop is closed. Brokers that died leave theirs
+// to the brokers still running.
+func SweepStaleBindings(db *gorm.DB) func(stop <-chan struct{}) {
+	return func(stop <-chan struct{}) {
+		ticker := time.NewTicker(StaleBindingsInterval)
+		defer ticker.Stop()
+
+		for {
+			FailStaleBindings(db)
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// FailRunningBindings marks the binding operations still running in this
+// process as failed and returns how many there were
+func FailRunningBindings(db *gorm.DB) int64 {
+	runningBindings.Lock()
+	ids := []int64{}
+	for id := range runningBindings.ids {
+		ids = append(ids, id)
+	}
+	runningBindings.Unlock()
+
+	if len(ids) == 0 {
+		return 0
+	}
+	return db.Model(Binding{}).
+		Where("id IN (?) AND state = ?", ids, StateInProgress).
+		UpdateColumns(stoppedBindingColumns).RowsAffected
+}
+
+// The parameters bind requests accept
+type bindParameters struct {
+	ReadOnly   bool   `json:"read_only"`
+	ValidUntil string `json:"valid_until"`
+}
+
+func (b *Binding) parameters() bindParameters {
+	var bp bindParameters
+	if b.Parameters != "" {
+		json.Unmarshal([]byte(b.Parameters), &bp)
+	}
+	return bp
+}
+
+// ReadOnly reports whether the binding asked for a read-only role
+func (b *Binding) ReadOnly() bool {
+	return b.parameters().ReadOnly
+}
+
+// NeedsRole reports whether the binding gets a role of its own
+func (b *Binding) NeedsRole() bool {
+	return b.ReadOnly() || b.Kind == BindingServiceKey
+}
+
+// SameRequest reports whether other was asked for with the same bind
+// request as the binding
+func (b *Binding) SameRequest(other *Binding) bool {
+	return b.Kind == other.Kind && b.AppGuid == other.AppGuid && sameJSON(b.Parameters, other.Parameters)
+}
+
+// sameJSON reports whether a and b hold the same JSON object, empty when
+// missing
+func sameJSON(a, b string) bool {
+	var objectA, objectB map[string]interface{}
+	if a != "" {
+		json.Unmarshal([]byte(a), &objectA)
+	}
+	if b != "" {
+		json.Unmarshal([]byte(b), &objectB)
+	}
+	if len(objectA) == 0 && len(objectB) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(objectA, objectB)
+}
+
+// SetBindRequest takes what the binding is for and its expiry from the bind
+// request
+func (b *Binding) SetBindRequest(br *bindReq) error {
+	b.Parameters = string(br.Parameters)
+
+	b.Kind = BindingServiceKey
+	b.AppGuid = br.BindResource.AppGuid
+	if b.AppGuid == "" {
+		b.AppGuid = br.AppGuid
+	}
+	if b.AppGuid != "" {
+		b.Kind = BindingApp
+	}
+
+	bp := b.parameters()
+	if bp.ValidUntil == "" {
+		return nil
+	}
+	if b.Kind != BindingServiceKey {
+		return errors.New("Only service keys can expire")
+	}
+
+	validUntil, err := time.Parse(time.RFC3339, bp.ValidUntil)
+	if err != nil {
+		return errors.New("valid_until has to be an RFC 3339 time")
+	}
+	if validUntil.Before(time.Now()) {
+		return errors.New("valid_until has to be in the future")
+	}
+	b.ValidUntil = validUntil.UTC()
+	return nil
+}
+
+// ReadOnlyStatements returns the SQL that creates a role that can only read
+// the database of the instance. The host statements run on the host, the
+// database ones in the instance database as its owner, so the default
+// privileges cover the tables the owner creates later.
+func ReadOnlyStatements(instance *Instance, username, password string) (host, database []string) {
+	host = []string{
+		fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s'", username, password),
+		fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s", instance.Database, username),
+		// Otherwise every role may make temporary tables
+		fmt.Sprintf("REVOKE TEMP ON DATABASE %s FROM PUBLIC", instance.Database),
+	}
+	database = []string{
+		fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s", username),
+		fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA public TO %s", username),
+		fmt.Sprintf("GRANT SELECT ON ALL SEQUENCES IN SCHEMA public TO %s", username),
+		fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT SELECT ON TABLES TO %s", instance.Username, username),
+		fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public GRANT SELECT ON SEQUENCES TO %s", instance.Username, username),
+	}
+	return host, database
+}
+
+// PublicSchemaStatements returns the SQL that stops the roles other than the
+// instance role from creating tables in the public schema, which they all
+// can before Postgres 15. It runs in the instance database as the host
+// role, the owner of the schema.
+func PublicSchemaStatements(instance *Instance) []string {
+	return []string{
+		"REVOKE CREATE ON SCHEMA public FROM PUBLIC",
+		fmt.Sprintf("GRANT CREATE ON SCHEMA public TO %s", instance.Username),
+	}
+}
+
+// DropReadOnlyStatements returns the SQL that undoes ReadOnlyStatements
+func DropReadOnlyStatements(instance *Instance, username string) (host, database []string) {
+	database = []string{
+		fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public REVOKE ALL ON TABLES FROM %s", instance.Username, username),
+		fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public REVOKE ALL ON SEQUENCES FROM %s", instance.Username, username),
+		fmt.Sprintf("REVOKE ALL ON ALL TABLES IN SCHEMA public FROM %s", username),
+		fmt.Sprintf("REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM %s", username),
+		fmt.Sprintf("REVOKE ALL ON SCHEMA public FROM %s", username),
+	}
+	host = []string{
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", instance.Database, username),
+		fmt.Sprintf("DROP USER IF EXISTS %s", username),
+	}
+	return host, database
+}
+
+// RoleStatements returns the SQL that creates the role of the binding: a
+// read-only one, or for service keys one that acts as the instance role.
+// Either gets the profile of the instance plan.
+func RoleStatements(instance *Instance, binding *Binding, password string) (host, database []string) {
+	if binding.ReadOnly() {
+		host, database = ReadOnlyStatements(instance, binding.Username, password)
+	} else {
+		host = []string{
+			fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s' IN ROLE %s", binding.Username, password, instance.Username),
+			// So what the key creates belongs to the instance role
+			fmt.Sprintf("ALTER ROLE %s SET ROLE %s", binding.Username, instance.Username),
+		}
+	}
+
+	if !binding.ValidUntil.IsZero() {
+		host = append(host, fmt.Sprintf("ALTER ROLE %s VALID UNTIL '%s'", binding.Username, binding.ValidUntil.Format(time.RFC3339)))
+	}
+	host = append(host, InstanceProfile(instance).Statements(binding.Username)...)
+	return host, database
+}
+
+// DropRoleStatements returns the SQL that undoes RoleStatements
+func DropRoleStatements(instance *Instance, binding *Binding) (host, database []string) {
+	twin := fmt.Sprintf("DROP USER IF EXISTS %s", TwinRole(binding.Username))
+	if binding.ReadOnly() {
+		host, database = DropReadOnlyStatements(instance, binding.Username)
+		return append([]string{twin}, host...), database
+	}
+	return []string{twin, fmt.Sprintf("DROP USER IF EXISTS %s", binding.Username)}, nil
+}
+
+// CreateBindingRole gives the binding its own role
+func CreateBindingRole(instance *Instance, binding *Binding, hosts *HostRegistry, s *Settings, l *Logger) error {
+	host, err := hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+
+	if binding.Username != "" {
+		// A retried bind cleans up after the failed attempt
+		if err := DropBindingRole(instance, binding, hosts, s, l); err != nil {
+			l.Error("Error dropping the role of the failed bind", err)
+		}
+	}
+
+	password := randStr(25)
+	binding.LoginRole = ""
+	binding.RetiringRole = ""
+	binding.RotatedAt = time.Time{}
+	binding.Username = "b" + randStr(15)
+	if binding.Kind == BindingServiceKey {
+		binding.Username = "k" + randStr(15)
+	}
+	binding.Salt = GenerateSalt(aes.BlockSize)
+	if err := binding.SetPassword(password, s.EncryptionKey); err != nil {
+		return err
+	}
+
+	hostStatements, dbStatements := RoleStatements(instance, binding, password)
+	if err := execAll(host.DB, l, hostStatements); err != nil {
+		return err
+	}
+	if len(dbStatements) == 0 {
+		return nil
+	}
+
+	hostDB, err := hosts.OpenInstanceDBAsHost(instance)
+	if err != nil {
+		return err
+	}
+	defer hostDB.Close()
+	if err := execAll(&hostDB, l, PublicSchemaStatements(instance)); err != nil {
+		return err
+	}
+
+	db, err := hosts.OpenInstanceDB(instance, s.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return execAll(&db, l, dbStatements)
+}
+
+// DropBindingRole removes the role of the binding
+func DropBindingRole(instance *Instance, binding *Binding, hosts *HostRegistry, s *Settings, l *Logger) error {
+	host, err := hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+
+	hostStatements, dbStatements := DropRoleStatements(instance, binding)
+
+	if len(dbStatements) > 0 {
+		db, err := hosts.OpenInstanceDB(instance, s.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := execAll(&db, l, dbStatements); err != nil {
+			return err
+		}
+	}
+	return execAll(host.DB, l, hostStatements)
+}
+
+func execAll(db *gorm.DB, l *Logger, statements []string) error {
+	return execAllWith(hostExec, db, l, statements)
+}
+
+// execAllWith runs the statements with exec, stopping at the first error
+func execAllWith(exec func(*gorm.DB, *Logger, string) error, db *gorm.DB, l *Logger, statements []string) error {
+	for _, statement := range statements {
+		if err := exec(db, l, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForBinding polls the last operation of the binding until it is no
+// longer in progress
+func waitForBinding(m *martini.ClassicMartini, url string, t *testing.T) (int, Operation) {
+	var operation Operation
+	for i := 0; i < 50; i++ {
+		res, _ := doRequest(m, url+"/last_operation", "GET", true, nil)
+		if res.Code != http.StatusOK {
+			return res.Code, operation
+		}
+
+		json.Unmarshal(res.Body.Bytes(), &operation)
+		if operation.State != StateInProgress {
+			return res.Code, operation
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(url, "is still in progress")
+	return 0, operation
+}
+
+func TestAsyncBinding(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	res, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, appBinding())
+	if res.Code != http.StatusAccepted {
+		t.Fatal(url, "with accepts_incomplete should return 202 and it returned", res.Code)
+	}
+
+	var async AsyncResponse
+	json.Unmarshal(res.Body.Bytes(), &async)
+	if async.Operation != OperationBind {
+		t.Error(url, "should return the bind operation and it returned", async.Operation)
+	}
+
+	code, operation := waitForBinding(m, url, t)
+	if code != http.StatusOK || operation.State != StateSucceeded {
+		t.Fatal(url, "should have succeeded and it returned", code, operation.State)
+	}
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "should be fetchable once bound and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
+	if res.Code != http.StatusAccepted {
+		t.Fatal(url, "async unbind should return 202 and it returned", res.Code)
+	}
+
+	code, _ = waitForBinding(m, url, t)
+	if code != http.StatusGone {
+		t.Error(url, "should be gone after the unbind and it returned", code)
+	}
+}
+
+func TestFailStaleBindings(t *testing.T) {
+	setup()
+
+	binding := Binding{Uuid: "stale", InstanceUuid: "the_instance", Operation: OperationBind, State: StateInProgress}
+	DB.Save(&binding)
+	DB.Model(&binding).UpdateColumn("updated_at", time.Now().Add(-2*StaleOperationAge))
+
+	FailStaleBindings(&DB)
+
+	DB.First(&binding, binding.Id)
+	if binding.State != StateFailed {
+		t.Error("A stale binding should be failed and it is", binding.State)
+	}
+}
+
+func TestAbandonedBindings(t *testing.T) {
+	setup()
+
+	binding := Binding{Uuid: "running", InstanceUuid: "the_instance"}
+	jobs := NewJobs()
+	done := make(chan struct{})
+	RunBindingOperation(&DB, jobs, &binding, OperationBind, true, Log, func() error {
+		<-done
+		return nil
+	})
+
+	if count := AbandonOperations(&DB); count != 1 {
+		t.Error("The running bind should be abandoned and it abandoned", count)
+	}
+	saved := Binding{}
+	DB.First(&saved, binding.Id)
+	if saved.State != StateFailed {
+		t.Error("The abandoned bind should be failed and it is", saved.State)
+	}
+
+	close(done)
+	jobs.Stop(time.Second)
+}
+
+func TestBindingConflict(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	doRequest(m, url, "PUT", true, appBinding())
+
+	res, _ := doRequest(m, url, "PUT", true, appBinding())
+	if res.Code != http.StatusOK {
+		t.Error(url, "with the same parameters should return 200 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBufferString(`{"bind_resource": {"app_guid": "other-app"}}`))
+	if res.Code != http.StatusConflict {
+		t.Error(url, "for another app should return 409 and it returned", res.Code)
+	}
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBufferString(`{"bind_resource": {"app_guid": "the-app"}, "parameters": {"read_only": true}}`))
+	if res.Code != http.StatusConflict {
+		t.Error(url, "with other parameters should return 409 and it returned", res.Code)
+	}
+}
+
+func TestBindingConcurrency(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	doRequest(m, url, "PUT", true, appBinding())
+
+	binding := Binding{}
+	DB.Where("uuid = ?", "the_binding").First(&binding)
+	DB.Model(&binding).UpdateColumns(map[string]interface{}{"operation": OperationUnbind, "state": StateInProgress})
+
+	res, _ := doRequest(m, url+"?accepts_incomplete=true", "PUT", true, appBinding())
+	if res.Code != 422 {
+		t.Error(url, "during an unbind should return 422 and it returned", res.Code)
+	}
+	var body ErrorResponse
+	json.Unmarshal(res.Body.Bytes(), &body)
+	if body.Error != "ConcurrencyError" {
+		t.Error(url, "during an unbind should be a ConcurrencyError and it was", body.Error)
+	}
+	DB.First(&binding, binding.Id)
+	if binding.Operation != OperationUnbind {
+		t.Error("The unbind in progress should be left alone and the binding has", binding.Operation)
+	}
+
+	DB.Model(&binding).UpdateColumns(map[string]interface{}{"operation": OperationBind, "state": StateInProgress})
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != 422 {
+		t.Error(url, "unbind during a bind should return 422 and it returned", res.Code)
+	}
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, appBinding())
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "repeated while the bind is in progress should return 202 and it returned", res.Code)
+	}
+}
+
+func TestRetryFailedBinding(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	failHostStatement = "CREATE USER"
+	doRequest(m, url, "PUT", true, bytes.NewBufferString(`{"bind_resource": {"app_guid": "the-app"}, "parameters": {"read_only": true}}`))
+	failHostStatement = ""
+
+	res, _ := doRequest(m, url, "PUT", true, appBinding())
+	if res.Code != http.StatusCreated {
+		t.Fatal(url, "retried should return 201 and it returned", res.Code)
+	}
+
+	binding := Binding{}
+	DB.Where("uuid = ?", "the_binding").First(&binding)
+	if binding.ReadOnly() || binding.Username != "" {
+		t.Error("The retry should make the binding it asked for and it has", binding.Parameters, binding.Username)
+	}
+}
+
+func TestReadOnlyStatements(t *testing.T) {
+	instance := Instance{Database: "dbname", Username: "owner"}
+	host, database := ReadOnlyStatements(&instance, "reader", "secret")
+
+	all := strings.Join(append(host, database...), ";")
+	for _, grant := range []string{
+		"CREATE USER reader WITH PASSWORD 'secret'",
+		"GRANT CONNECT ON DATABASE dbname TO reader",
+		"GRANT USAGE ON SCHEMA public TO reader",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA public TO reader",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE owner IN SCHEMA public GRANT SELECT ON TABLES TO reader",
+	} {
+		if !strings.Contains(all, grant) {
+			t.Error("The read-only role should get", grant)
+		}
+	}
+	for _, privilege := range []string{"INSERT", "UPDATE", "DELETE", "ALL PRIVILEGES", "CREATE ON"} {
+		if strings.Contains(all, privilege) {
+			t.Error("The read-only role should not get", privilege)
+		}
+	}
+
+	if !strings.Contains(all, "REVOKE TEMP ON DATABASE dbname FROM PUBLIC") {
+		t.Error("The read-only role should not be able to make temporary tables")
+	}
+	public := strings.Join(PublicSchemaStatements(&instance), ";")
+	if !strings.Contains(public, "REVOKE CREATE ON SCHEMA public FROM PUBLIC") || !strings.Contains(public, "GRANT CREATE ON SCHEMA public TO owner") {
+		t.Error("Only the owner should create in the public schema and the statements are", public)
+	}
+
+	// The role gets the profile of the plan
+	plan := BuildCatalog()[0].Plans[0]
+	instance.PlanId = plan.Id
+	host, _ = RoleStatements(&instance, &Binding{Username: "reader", Parameters: `{"read_only": true}`}, "secret")
+	limit := fmt.Sprintf("ALTER ROLE reader CONNECTION LIMIT %d", plan.Profile.ConnectionLimit)
+	if !strings.Contains(strings.Join(host, ";"), limit) {
+		t.Error("The read-only role should get", limit, "and it gets", host)
+	}
+
+	host, _ = DropReadOnlyStatements(&instance, "reader")
+	if host[len(host)-1] != "DROP USER IF EXISTS reader" {
+		t.Error("Dropping the read-only role should end with the role and it ends with", host[len(host)-1])
+	}
+}
+
+func TestReadOnlyBinding(t *testing.T) {
+	if !(&Binding{Parameters: `{"read_only": true}`}).ReadOnly() {
+		t.Error("read_only should make a read-only binding")
+	}
+	if (&Binding{}).ReadOnly() {
+		t.Error("Bindings should not be read-only by default")
+	}
+
+	// When the role can't be created the bind has to fail rather than hand
+	// out the credentials of the owner
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	failHostStatement = "CREATE USER"
+	defer func() { failHostStatement = "" }()
+	res, _ := doRequest(m, url, "PUT", true, bytes.NewBufferString(`{"bind_resource": {"app_guid": "the-app"}, "parameters": {"read_only": true}}`))
+	if res.Code != http.StatusInternalServerError {
+		t.Error(url, "should fail without a read-only role and it returned", res.Code)
+	}
+
+	binding := Binding{}
+	DB.Where("uuid = ?", "the_binding").First(&binding)
+	if binding.State != StateFailed {
+		t.Error("The binding should be failed and it is", binding.State)
+	}
+}
+
+func TestServiceKeys(t *testing.T) {
+	var binding Binding
+	binding.SetBindRequest(&bindReq{BindResource: bindResource{AppGuid: "the-app"}})
+	if binding.Kind != BindingApp || binding.AppGuid != "the-app" || binding.NeedsRole() {
+		t.Error("A bind for an app should be an app binding and it is", binding.Kind)
+	}
+
+	validUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	binding = Binding{}
+	err := binding.SetBindRequest(&bindReq{Parameters: []byte(`{"valid_until": "` + validUntil.Format(time.RFC3339) + `"}`)})
+	if err != nil || binding.Kind != BindingServiceKey || !binding.NeedsRole() {
+		t.Fatal("A bind without an app should be a service key", err)
+	}
+	if !binding.ValidUntil.Equal(validUntil) {
+		t.Error("The service key should expire at", validUntil, "and it expires at", binding.ValidUntil)
+	}
+
+	for _, parameters := range []string{`{"valid_until": "tomorrow"}`, `{"valid_until": "2001-01-01T00:00:00Z"}`} {
+		if err := (&Binding{}).SetBindRequest(&bindReq{Parameters: []byte(parameters)}); err == nil {
+			t.Error(parameters, "should be refused")
+		}
+	}
+	if err := (&Binding{}).SetBindRequest(&bindReq{AppGuid: "the-app", Parameters: []byte(`{"valid_until": "2101-01-01T00:00:00Z"}`)}); err == nil {
+		t.Error("App bindings should not expire")
+	}
+
+	binding.Username = "key"
+	host, _ := RoleStatements(&Instance{Username: "owner"}, &binding, "secret")
+	all := strings.Join(host, ";")
+	for _, statement := range []string{"IN ROLE owner", "ALTER ROLE key SET ROLE owner", "VALID UNTIL '" + validUntil.Format(time.RFC3339) + "'"} {
+		if !strings.Contains(all, statement) {
+			t.Error("The role of the service key should get", statement)
+		}
+	}
+}
+
+func TestListServiceKeys(t *testing.T) {
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	doRequest(m, "/v2/service_instances/the_instance/service_bindings/the_binding", "PUT", true, appBinding())
+	doRequest(m, "/v2/service_instances/the_instance/service_bindings/the_key", "PUT", true, bytes.NewBufferString(`{}`))
+
+	url := "/admin/service_keys?instance_id=the_instance"
+	res, _ := doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Fatal(url, "should return 200 and it returned", res.Code)
+	}
+
+	var response struct {
+		ServiceKeys map[string][]serviceKeyResponse `json:"service_keys"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	keys := response.ServiceKeys["the_instance"]
+	if len(keys) != 1 || keys[0].BindingId != "the_key" {
+		t.Error(url, "should only list the service key and it returned", string(res.Body.Bytes()))
+	}
+}
@@ -1,37 +1,81 @@
 package main
 
+import (
+	"gopkg.in/yaml.v2"
+
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
 type Metadata struct {
-	DisplayName         string `json:"displayName"`
-	ImageUrl            string `json:"imageUrl"`
-	LongDescription     string `json:"longDescription"`
-	ProviderDisplayName string `json:"providerDisplayName"`
-	DocumentationUrl    string `json:"documentationUrl"`
-	SupportUrl          string `json:"supportUrl"`
+	DisplayName         string `json:"displayName" yaml:"displayName"`
+	ImageUrl            string `json:"imageUrl" yaml:"imageUrl"`
+	LongDescription     string `json:"longDescription" yaml:"longDescription"`
+	ProviderDisplayName string `json:"providerDisplayName" yaml:"providerDisplayName"`
+	DocumentationUrl    string `json:"documentationUrl" yaml:"documentationUrl"`
+	SupportUrl          string `json:"supportUrl" yaml:"supportUrl"`
 }
 type PlanCost struct {
-	Amount map[string]float64 `json:"amount"`
-	Unit   string             `json:"unit"`
+	Amount map[string]float64 `json:"amount" yaml:"amount"`
+	Unit   string             `json:"unit" yaml:"unit"`
 }
 type PlanMetadata struct {
-	Bullets     []string   `json:"bullets"`
-	Costs       []PlanCost `json:"costs"`
-	DisplayName string     `json:"displayName"`
+	Bullets     []string   `json:"bullets" yaml:"bullets"`
+	Costs       []PlanCost `json:"costs" yaml:"costs"`
+	DisplayName string     `json:"displayName" yaml:"displayName"`
 }
 type Plan struct {
-	Id          string       `json:"id"`
-	Name        string       `json:"name"`
-	Description string       `json:"description"`
-	Metadata    PlanMetadata `json:"metadata"`
+	Id          string       `json:"id" yaml:"id"`
+	Name        string       `json:"name" yaml:"name"`
+	Description string       `json:"description" yaml:"description"`
+	Metadata    PlanMetadata `json:"metadata" yaml:"metadata"`
+
+	// Broker settings, not part of the catalog
+	StorageLimitMB int64       `json:"-" yaml:"storage_limit_mb"`
+	Profile        RoleProfile `json:"-" yaml:"profile"`
+	// The optional credential fields bindings of the plan get
+	Credentials []string `json:"-" yaml:"credentials"`
+}
+
+// The optional credential fields
+const (
+	CredentialPort          = "port"
+	CredentialSslmode       = "sslmode"
+	CredentialCACertificate = "ca_certificate"
+	CredentialJdbcUrl       = "jdbcUrl"
+)
+
+// The credential fields plans can list
+var credentialFields = map[string]bool{
+	CredentialPort:          true,
+	CredentialSslmode:       true,
+	CredentialCACertificate: true,
+	CredentialJdbcUrl:       true,
+}
+
+// Includes reports whether bindings of the plan get the credential field
+func (p *Plan) Includes(field string) bool {
+	for _, f := range p.Credentials {
+		if f == field {
+			return true
+		}
+	}
+	return false
 }
 
 type Service struct {
-	Id          string   `json:"id"`
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Bindable    bool     `json:"bindable"`
-	Tags        []string `json:"tags"`
-	Metadata    Metadata `json:"metadata"`
-	Plans       []Plan   `json:"plans"`
+	Id             string   `json:"id" yaml:"id"`
+	Name           string   `json:"name" yaml:"name"`
+	Description    string   `json:"description" yaml:"description"`
+	Bindable       bool     `json:"bindable" yaml:"bindable"`
+	PlanUpdateable bool     `json:"plan_updateable" yaml:"plan_updateable"`
+	Tags           []string `json:"tags" yaml:"tags"`
+	Metadata       Metadata `json:"metadata" yaml:"metadata"`
+	Plans          []Plan   `json:"plans" yaml:"plans"`
+
+	InstancesRetrievable bool `json:"instances_retrievable" yaml:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable" yaml:"bindings_retrievable"`
 }
 
 func BuildCatalog() []Service {
@@ -51,19 +95,79 @@ func BuildCatalog() []Service {
 			},
 			DisplayName: "Free Shared Plan",
 		},
+		StorageLimitMB: 1024,
+		Profile: RoleProfile{
+			ConnectionLimit:                 10,
+			StatementTimeout:                "60s",
+			IdleInTransactionSessionTimeout: "10min",
+			WorkMem:                         "4MB",
+		},
+		Credentials: []string{CredentialPort, CredentialSslmode, CredentialCACertificate, CredentialJdbcUrl},
 	}
 	service := Service{
-		Id:          "db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
-		Name:        "rds-database",
-		Description: "RDS Database Broker",
-		Bindable:    true,
-		Tags:        []string{"database", "RDS", "postgresql"},
+		Id:             "db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+		Name:           "rds-database",
+		Description:    "RDS Database Broker",
+		Bindable:       true,
+		PlanUpdateable: true,
+		Tags:           []string{"database", "RDS", "postgresql"},
 		Metadata: Metadata{
 			DisplayName:         "RDS Database Broker",
 			ProviderDisplayName: "RDS",
 		},
 		Plans: []Plan{freePlan},
+
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
 	}
 
 	return []Service{service}
 }
+
+// The services and plans the broker offers
+var Catalog = BuildCatalog()
+
+// LoadCatalog reads the services, in the layout of the catalog endpoint
+// with the broker settings of the plans, from a YAML or JSON file
+func LoadCatalog(path string) ([]Service, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog struct {
+		Services []Service `yaml:"services"`
+	}
+	if err := yaml.UnmarshalStrict(content, &catalog); err != nil {
+		return nil, err
+	}
+	if len(catalog.Services) == 0 {
+		return nil, errors.New("The catalog has no services")
+	}
+
+	for _, service := range catalog.Services {
+		if service.Id == "" || service.Name == "" || len(service.Plans) == 0 {
+			return nil, errors.New("Every service needs an id, a name and plans")
+		}
+		for _, plan := range service.Plans {
+			if plan.Id == "" || plan.Name == "" {
+				return nil, fmt.Errorf("Every plan of service %s needs an id and a name", service.Name)
+			}
+		}
+	}
+
+	return catalog.Services, nil
+}
+
+// FindPlan looks up a plan of the catalog by id
+func FindPlan(id string) *Plan {
+	for _, service := range Catalog {
+		for _, plan := range service.Plans {
+			if plan.Id == id {
+				return &plan
+			}
+		}
+	}
+
+	return nil
+}
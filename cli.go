@@ -0,0 +1,717 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A command of the admin CLI, run with the broker DB and hosts
+type command struct {
+	usage string
+	run   func(c *commandContext, args []string) error
+	// Run with the metadata DB as it is, not migrated and without the hosts
+	metadataOnly bool
+}
+
+type commandContext struct {
+	db    *gorm.DB
+	hosts *HostRegistry
+	s     *Settings
+	out   io.Writer
+	json  bool
+}
+
+var commands = map[string]command{
+	"list":       {"list [-json]", listCommand, false},
+	"show":       {"show [-json] [-reveal] <instance id>", showCommand, false},
+	"delete":     {"delete <instance id>", deleteCommand, false},
+	"rotate-key": {"rotate-key -new-key <key>", rotateKeyCommand, false},
+	"reconcile":  {"reconcile [-json] [-drop-orphans -yes]", reconcileCommand, false},
+	"copy-state": {"copy-state [-json]", copyStateCommand, false},
+	"migrate":    {"migrate status [-json] | up [-to <version>] | down [-to <version>]", migrateCommand, true},
+}
+
+// RunCommand runs the admin command in args and returns the exit code
+func RunCommand(args []string, s *Settings, out io.Writer) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	var err error
+	if cmd.metadataOnly {
+		err = DBInit(s.MetadataRds(), "prod", s.DBConnectTimeout)
+		s.Dialect = dialectName(&DB)
+	} else {
+		err = Init(s, "prod")
+	}
+	if err != nil {
+		Log.Error("Error connecting", err)
+		return 1
+	}
+
+	if err := runCommand(args, &DB, Hosts, s, out); err != nil {
+		fmt.Fprintln(os.Stderr, Redact(err.Error()))
+		return 1
+	}
+	return 0
+}
+
+func runCommand(args []string, db *gorm.DB, hosts *HostRegistry, s *Settings, out io.Writer) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command %s", args[0])
+	}
+
+	c := &commandContext{db: db, hosts: hosts, s: s, out: out}
+	return cmd.run(c, args[1:])
+}
+
+func printUsage(w io.Writer) {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: rds-broker [command]")
+	fmt.Fprintln(w, "Without a command the broker is started. The commands are:")
+	for _, name := range names {
+		fmt.Fprintln(w, "  rds-broker", commands[name].usage)
+	}
+}
+
+// flags returns the flag set of a command, with the -json flag
+func (c *commandContext) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&c.json, "json", false, "Print JSON instead of a table")
+	return fs
+}
+
+// print writes value as JSON, or rows as a table
+func (c *commandContext) print(value interface{}, header []string, rows [][]string) error {
+	if c.json {
+		encoded, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.out, string(encoded))
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+type instanceSummary struct {
+	Id           string    `json:"id"`
+	PlanId       string    `json:"plan_id"`
+	OrgGuid      string    `json:"organization_guid"`
+	SpaceGuid    string    `json:"space_guid"`
+	Host         string    `json:"host"`
+	Database     string    `json:"database"`
+	StorageState string    `json:"storage_state"`
+	StorageBytes int64     `json:"storage_bytes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newInstanceSummary(instance *Instance) instanceSummary {
+	host := instance.Host
+	if host == "" {
+		host = DefaultHostName
+	}
+	state := instance.StorageState
+	if state == "" {
+		state = StorageOk
+	}
+
+	return instanceSummary{
+		Id:           instance.Uuid,
+		PlanId:       instance.PlanId,
+		OrgGuid:      instance.OrgGuid,
+		SpaceGuid:    instance.SpaceGuid,
+		Host:         host,
+		Database:     instance.Database,
+		StorageState: state,
+		StorageBytes: instance.StorageBytes,
+		CreatedAt:    instance.CreatedAt,
+	}
+}
+
+func listCommand(c *commandContext, args []string) error {
+	if err := c.flags("list").Parse(args); err != nil {
+		return err
+	}
+
+	var instances []Instance
+	c.db.Order("created_at").Find(&instances)
+
+	summaries := []instanceSummary{}
+	rows := [][]string{}
+	for i := range instances {
+		summary := newInstanceSummary(&instances[i])
+		summaries = append(summaries, summary)
+		rows = append(rows, []string{
+			summary.Id,
+			summary.PlanId,
+			summary.OrgGuid,
+			summary.SpaceGuid,
+			summary.Host,
+			summary.Database,
+			summary.StorageState,
+			summary.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return c.print(summaries, []string{"ID", "PLAN", "ORG", "SPACE", "HOST", "DATABASE", "STORAGE", "CREATED"}, rows)
+}
+
+type bindingSummary struct {
+	Id          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	AppGuid     string            `json:"app_guid,omitempty"`
+	State       string            `json:"state"`
+	Credentials map[string]string `json:"credentials,omitempty"`
+}
+
+type instanceDetails struct {
+	instanceSummary
+	LoginRole   string            `json:"login_role"`
+	Bindings    []bindingSummary  `json:"bindings"`
+	Credentials map[string]string `json:"credentials,omitempty"`
+}
+
+func showCommand(c *commandContext, args []string) error {
+	fs := c.flags("show")
+	reveal := fs.Bool("reveal", false, "Print the decrypted credentials")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Usage: rds-broker show [-json] [-reveal] <instance id>")
+	}
+
+	instance := Instance{}
+	c.db.Where("uuid = ?", fs.Arg(0)).First(&instance)
+	if instance.Id == 0 {
+		return errors.New("Instance not found")
+	}
+
+	details := instanceDetails{
+		instanceSummary: newInstanceSummary(&instance),
+		LoginRole:       instance.LoginUsername(),
+		Bindings:        []bindingSummary{},
+	}
+
+	var err error
+	if *reveal {
+		details.Credentials, err = Credentials(&instance, nil, c.hosts, c.s)
+		if err != nil {
+			return err
+		}
+	}
+
+	var bindings []Binding
+	c.db.Where("instance_uuid = ?", instance.Uuid).Order("created_at").Find(&bindings)
+	for i := range bindings {
+		binding := &bindings[i]
+		summary := bindingSummary{Id: binding.Uuid, Kind: binding.Kind, AppGuid: binding.AppGuid, State: binding.State}
+		if *reveal && binding.Username != "" {
+			summary.Credentials, err = Credentials(&instance, binding, c.hosts, c.s)
+			if err != nil {
+				return err
+			}
+		}
+		details.Bindings = append(details.Bindings, summary)
+	}
+
+	if c.json {
+		return c.print(details, nil, nil)
+	}
+
+	rows := [][]string{
+		{"id", details.Id},
+		{"plan", details.PlanId},
+		{"org", details.OrgGuid},
+		{"space", details.SpaceGuid},
+		{"host", details.Host},
+		{"database", details.Database},
+		{"login role", details.LoginRole},
+		{"storage", fmt.Sprintf("%s (%d bytes)", details.StorageState, details.StorageBytes)},
+		{"created", details.CreatedAt.Format(time.RFC3339)},
+	}
+	rows = append(rows, credentialRows("", details.Credentials)...)
+	for _, binding := range details.Bindings {
+		rows = append(rows, []string{"binding " + binding.Id, strings.TrimSpace(binding.Kind + " " + binding.AppGuid + " " + binding.State)})
+		rows = append(rows, credentialRows("binding "+binding.Id+" ", binding.Credentials)...)
+	}
+
+	return c.print(nil, []string{"FIELD", "VALUE"}, rows)
+}
+
+func credentialRows(prefix string, credentials map[string]string) [][]string {
+	keys := []string{}
+	for key := range credentials {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := [][]string{}
+	for _, key := range keys {
+		// Keep multi-line values, like the CA certificate, on one line
+		value := strings.Replace(credentials[key], "\n", `\n`, -1)
+		rows = append(rows, []string{prefix + "credentials." + key, value})
+	}
+	return rows
+}
+
+func deleteCommand(c *commandContext, args []string) error {
+	fs := c.flags("delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Usage: rds-broker delete <instance id>")
+	}
+
+	instance := Instance{}
+	c.db.Where("uuid = ?", fs.Arg(0)).First(&instance)
+	if instance.Id == 0 {
+		return errors.New("Instance not found")
+	}
+
+	if err := Deprovision(c.db, c.hosts, &instance, Log.With("instance_id", instance.Uuid)); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out, "Deleted instance", instance.Uuid)
+	return nil
+}
+
+// rotateKeyCommand encrypts every stored password with a new encryption
+// key. The broker has to be restarted with the new key afterwards.
+func rotateKeyCommand(c *commandContext, args []string) error {
+	fs := c.flags("rotate-key")
+	newKey := fs.String("new-key", "", "The new encryption key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *newKey == "" {
+		return errors.New("Usage: rds-broker rotate-key -new-key <key>")
+	}
+
+	count, err := RotateEncryptionKey(c.db, c.s.Dialect, c.s.EncryptionKey, *newKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "Encrypted %d passwords with the new key. Restart the broker with ENC_KEY set to it.\n", count)
+	return nil
+}
+
+// RotateEncryptionKey re-encrypts the passwords of the instances, bindings
+// and hosts from oldKey to newKey, all of them or none. A broker running
+// with oldKey would keep saving passwords encrypted with it, so it refuses
+// to run along one, or while operations are pending.
+func RotateEncryptionKey(db *gorm.DB, dialect, oldKey, newKey string) (int, error) {
+	if len(newKey) != len(oldKey) {
+		return 0, fmt.Errorf("The new key has to be %d bytes long", len(oldKey))
+	}
+
+	tx := db.Begin()
+	if err := checkNoBrokers(tx, dialect); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	count := 0
+	reencrypt := func(get func(string) (string, error), set func(string, string) error, save func() error) error {
+		password, err := get(oldKey)
+		if err != nil {
+			return err
+		}
+		if err := set(password, newKey); err != nil {
+			return err
+		}
+		count++
+		return save()
+	}
+
+	var instances []Instance
+	tx.Unscoped().Where("password <> ''").Find(&instances)
+	for i := range instances {
+		instance := &instances[i]
+		err := reencrypt(instance.GetPassword, instance.SetPassword, func() error {
+			return tx.Unscoped().Model(instance).UpdateColumn("password", instance.Password).Error
+		})
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("Error re-encrypting instance %s: %s", instance.Uuid, err)
+		}
+	}
+
+	var bindings []Binding
+	tx.Where("password <> ''").Find(&bindings)
+	for i := range bindings {
+		binding := &bindings[i]
+		err := reencrypt(binding.GetPassword, binding.SetPassword, func() error {
+			return tx.Model(binding).UpdateColumn("password", binding.Password).Error
+		})
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("Error re-encrypting binding %s: %s", binding.Uuid, err)
+		}
+	}
+
+	var hosts []Host
+	tx.Where("password <> ''").Find(&hosts)
+	for i := range hosts {
+		host := &hosts[i]
+		err := reencrypt(host.GetPassword, host.SetPassword, func() error {
+			return tx.Model(host).UpdateColumn("password", host.Password).Error
+		})
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("Error re-encrypting host %s: %s", host.Name, err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// checkNoBrokers fails when a broker is running or left operations
+// pending. With Postgres it holds the broker lock until tx ends, so no
+// broker starts in the meantime.
+func checkNoBrokers(tx *gorm.DB, dialect string) error {
+	if dialect == "postgres" {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", brokerLockKey).Row().Scan(&locked); err != nil {
+			return fmt.Errorf("Error taking the broker lock: %s", err)
+		}
+		if !locked {
+			return errors.New("A broker is running, stop every broker first")
+		}
+	}
+
+	var operations, bindings int
+	tx.Model(PendingOperation{}).Count(&operations)
+	tx.Model(Binding{}).Where("state = ?", StateInProgress).Count(&bindings)
+	if operations > 0 || bindings > 0 {
+		return fmt.Errorf("%d operations and %d bindings are pending, let the broker finish them first", operations, bindings)
+	}
+	return nil
+}
+
+type reconcileReport struct {
+	Host             string   `json:"host"`
+	OrphanDatabases  []string `json:"orphan_databases"`
+	MissingDatabases []string `json:"missing_databases"`
+	// Left alone while an operation is pending on them
+	BusyDatabases []string `json:"busy_databases"`
+}
+
+// Instance databases are named db followed by 15 characters
+var instanceDatabaseName = regexp.MustCompile(`^db[0-9a-z]{15}$`)
+
+// reconcileCommand compares the instances with the databases on each host
+func reconcileCommand(c *commandContext, args []string) error {
+	fs := c.flags("reconcile")
+	drop := fs.Bool("drop-orphans", false, "Drop the databases no instance knows about")
+	yes := fs.Bool("yes", false, "Confirm that the orphans are to be dropped")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *drop && !*yes {
+		return errors.New("-drop-orphans drops databases for good, check the report without it and add -yes")
+	}
+
+	reports, err := Reconcile(c.db, c.hosts)
+	if err != nil {
+		return err
+	}
+
+	if *drop {
+		for _, report := range reports {
+			host := c.hosts.Get(report.Host)
+			for _, database := range report.OrphanDatabases {
+				if err := ExecLogged(host.DB, Log, fmt.Sprintf("DROP DATABASE IF EXISTS %s;", database)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	rows := [][]string{}
+	for _, report := range reports {
+		for _, database := range report.OrphanDatabases {
+			state := "orphan"
+			if *drop {
+				state = "orphan, dropped"
+			}
+			rows = append(rows, []string{report.Host, database, state})
+		}
+		for _, database := range report.MissingDatabases {
+			rows = append(rows, []string{report.Host, database, "missing"})
+		}
+		for _, database := range report.BusyDatabases {
+			rows = append(rows, []string{report.Host, database, "busy"})
+		}
+	}
+
+	return c.print(reports, []string{"HOST", "DATABASE", "STATE"}, rows)
+}
+
+// Reconcile finds, on every host, the instance databases no instance knows
+// about and the instances whose database is gone. The databases of pending
+// operations are reported busy instead. They are looked up after the
+// databases and before the instances, so a provision or deprovision that
+// finishes in between is not mistaken for either.
+func Reconcile(db *gorm.DB, hosts *HostRegistry) ([]reconcileReport, error) {
+	reports := []reconcileReport{}
+	for _, host := range hosts.All() {
+		report := reconcileReport{Host: host.Name, OrphanDatabases: []string{}, MissingDatabases: []string{}, BusyDatabases: []string{}}
+
+		rows, err := host.DB.Raw(`SELECT datname FROM pg_database WHERE datname LIKE E'db\\_%' ESCAPE E'\\'`).Rows()
+		if err != nil {
+			return nil, fmt.Errorf("Error listing the databases of host %s: %s", host.Name, err)
+		}
+		found := map[string]bool{}
+		for rows.Next() {
+			var database string
+			if err := rows.Scan(&database); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if instanceDatabaseName.MatchString(database) {
+				found[database] = true
+			}
+		}
+		rows.Close()
+
+		var operations []PendingOperation
+		if err := db.Where("host = ?", host.Name).Find(&operations).Error; err != nil && err != gorm.RecordNotFound {
+			return nil, err
+		}
+		busy := map[string]bool{}
+		for _, op := range operations {
+			busy[op.Database] = true
+		}
+
+		var instances []Instance
+		query := db.Where("host = ?", host.Name)
+		if host.Name == DefaultHostName {
+			query = db.Where("host = ? OR host = '' OR host IS NULL", host.Name)
+		}
+		if err := query.Find(&instances).Error; err != nil && err != gorm.RecordNotFound {
+			return nil, err
+		}
+		expected := map[string]bool{}
+		for i := range instances {
+			expected[instances[i].Database] = true
+		}
+
+		for database := range found {
+			if busy[database] {
+				report.BusyDatabases = append(report.BusyDatabases, database)
+			} else if !expected[database] {
+				report.OrphanDatabases = append(report.OrphanDatabases, database)
+			}
+		}
+		for database := range expected {
+			if !found[database] && !busy[database] {
+				report.MissingDatabases = append(report.MissingDatabases, database)
+			}
+		}
+		sort.Strings(report.OrphanDatabases)
+		sort.Strings(report.MissingDatabases)
+		sort.Strings(report.BusyDatabases)
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// copyStateCommand copies the broker state from the database of the default
+// host, where it was kept before metadata was set, to the metadata DB
+func copyStateCommand(c *commandContext, args []string) error {
+	fs := c.flags("copy-state")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.s.Metadata == nil {
+		return errors.New("metadata (METADATA_DB_URL) is not set, the state is already in the database of the default host")
+	}
+	host := c.hosts.Get(DefaultHostName)
+	if host == nil {
+		return errors.New("There is no default host to copy the state from")
+	}
+
+	copied, err := CopyState(host.DB, c.db)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, model := range metadataModels {
+		table := c.db.NewScope(model).TableName()
+		rows = append(rows, []string{table, fmt.Sprint(copied[table])})
+	}
+	return c.print(copied, []string{"TABLE", "ROWS"}, rows)
+}
+
+// CopyState copies the rows of the broker tables from one DB to another,
+// all of them or none. The hosts already in to are kept, the config having
+// saved them there. It refuses to copy into a DB that has instances.
+func CopyState(from, to *gorm.DB) (map[string]int, error) {
+	var count int64
+	if err := to.Model(Instance{}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("The metadata DB already has %d instances", count)
+	}
+
+	tx := to.Begin()
+	copied := map[string]int{}
+	for _, model := range metadataModels {
+		table := tx.NewScope(model).TableName()
+		if !from.HasTable(model) {
+			continue
+		}
+
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model)))
+		if err := from.Order("id").Find(rows.Interface()).Error; err != nil && err != gorm.RecordNotFound {
+			tx.Rollback()
+			return nil, fmt.Errorf("Error reading %s: %s", table, err)
+		}
+
+		for i := 0; i < rows.Elem().Len(); i++ {
+			row := rows.Elem().Index(i)
+			if host, ok := row.Addr().Interface().(*Host); ok && !tx.Where("name = ?", host.Name).First(&Host{}).RecordNotFound() {
+				continue
+			}
+			if err := copyRow(tx, row); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("Error copying %s: %s", table, err)
+			}
+			copied[table]++
+		}
+	}
+
+	return copied, tx.Commit().Error
+}
+
+// copyRow inserts row with a new ID, nothing referring to the IDs, and
+// with its timestamps, which gorm sets on create
+func copyRow(db *gorm.DB, row reflect.Value) error {
+	timestamps := map[string]interface{}{}
+	for field, column := range map[string]string{"CreatedAt": "created_at", "UpdatedAt": "updated_at"} {
+		if value := row.FieldByName(field); value.IsValid() {
+			timestamps[column] = value.Interface()
+		}
+	}
+
+	row.FieldByName("Id").SetInt(0)
+	if err := db.Create(row.Addr().Interface()).Error; err != nil {
+		return err
+	}
+	return db.Model(row.Addr().Interface()).UpdateColumns(timestamps).Error
+}
+
+// migrateCommand shows the migrations of the metadata DB, applies them or
+// rolls them back. Down rolls back the last applied migration without -to.
+func migrateCommand(c *commandContext, args []string) error {
+	usage := errors.New("Usage: rds-broker migrate status [-json] | up [-to <version>] | down [-to <version>]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := c.flags("migrate " + args[0])
+	target := fs.Int64("to", -1, "The version to migrate to")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	migrator := NewMigrator(c.db, c.s)
+	var (
+		done []MigrationStatus
+		err  error
+	)
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		return c.printMigrations(statuses)
+	case "up":
+		if *target < 0 {
+			*target = 0
+		}
+		done, err = migrator.Up(*target)
+	case "down":
+		if *target < 0 {
+			if *target, err = previousMigration(migrator); err != nil {
+				return err
+			}
+		}
+		done, err = migrator.Down(*target)
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+	return c.printMigrations(done)
+}
+
+// previousMigration returns the version before the last applied migration
+func previousMigration(migrator *Migrator) (int64, error) {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := []int64{0}
+	for _, status := range statuses {
+		if status.State != MigrationPending {
+			applied = append(applied, status.Version)
+		}
+	}
+	if len(applied) == 1 {
+		return 0, errors.New("There is no migration to roll back")
+	}
+	return applied[len(applied)-2], nil
+}
+
+func (c *commandContext) printMigrations(statuses []MigrationStatus) error {
+	rows := [][]string{}
+	for _, status := range statuses {
+		appliedAt := ""
+		if status.AppliedAt != nil {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{fmt.Sprint(status.Version), status.Name, status.State, appliedAt})
+	}
+	return c.print(statuses, []string{"VERSION", "NAME", "STATE", "APPLIED AT"}, rows)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListCommand(t *testing.T) {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012"}
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBufferString(`{"plan_id":"the-plan"}`))
+	doRequest(m, "/v2/service_instances/other_instance", "PUT", true, newInstance())
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"list"}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("list failed", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "the-plan") {
+		t.Error("list should print a table of the instances and it printed", out.String())
+	}
+
+	out.Reset()
+	if err := runCommand([]string{"list", "-json"}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("list -json failed", err)
+	}
+	var summaries []instanceSummary
+	if err := json.Unmarshal(out.Bytes(), &summaries); err != nil || len(summaries) != 2 {
+		t.Error("list -json should print the instances as JSON and it printed", out.String())
+	}
+}
+
+func TestShowCommand(t *testing.T) {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012"}
+	setup()
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	password, _ := instance.GetPassword(s.EncryptionKey)
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"show", "the_instance"}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("show failed", err)
+	}
+	if !strings.Contains(out.String(), instance.Database) || strings.Contains(out.String(), password) {
+		t.Error("show should print the instance without its password and it printed", out.String())
+	}
+
+	out.Reset()
+	runCommand([]string{"show", "-reveal", "-json", "the_instance"}, &DB, Hosts, &s, &out)
+	var details instanceDetails
+	json.Unmarshal(out.Bytes(), &details)
+	if details.Credentials["password"] != password {
+		t.Error("show -reveal should print the password and it printed", out.String())
+	}
+
+	if err := runCommand([]string{"show", "unknown"}, &DB, Hosts, &s, &out); err == nil {
+		t.Error("show should fail for an unknown instance")
+	}
+}
+
+func TestDeleteCommand(t *testing.T) {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012"}
+	setup()
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"delete", "the_instance"}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("delete failed", err)
+	}
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	if instance.Id != 0 {
+		t.Error("delete should delete the instance")
+	}
+}
+
+func TestRotateKeyCommand(t *testing.T) {
+	oldKey := "12345678901234567890123456789012"
+	newKey := "abcdefghijklmnopqrstuvwxyz123456"
+	s := Settings{EncryptionKey: oldKey}
+	setup()
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	password, _ := instance.GetPassword(oldKey)
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"rotate-key", "-new-key", "short"}, &DB, Hosts, &s, &out); err == nil {
+		t.Error("rotate-key should refuse a key of the wrong size")
+	}
+
+	op := StartOperation(&DB, OperationProvision, &Instance{Uuid: "pending"})
+	if err := runCommand([]string{"rotate-key", "-new-key", newKey}, &DB, Hosts, &s, &out); err == nil {
+		t.Error("rotate-key should refuse to run while operations are pending")
+	}
+	op.Finish(&DB)
+
+	if err := runCommand([]string{"rotate-key", "-new-key", newKey}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("rotate-key failed", err)
+	}
+
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	if decrypted, err := instance.GetPassword(newKey); err != nil || decrypted != password {
+		t.Error("The password should be encrypted with the new key", err)
+	}
+}
+
+func TestCopyStateCommand(t *testing.T) {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012", Dialect: "sqlite3"}
+	setup()
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	// The state was kept in the database of the default host
+	old := Hosts.Get(DefaultHostName).DB
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	NewMigrator(old, &s).Up(0)
+	instance := Instance{Uuid: "old_instance", Database: "db_old"}
+	old.Create(&instance)
+	old.Model(&instance).UpdateColumn("created_at", created)
+	old.Create(&Quota{Scope: "org", Guid: "the-org", Limit: 3})
+	old.Create(&Host{Name: DefaultHostName, Url: "stale.example.com"})
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"copy-state"}, &DB, Hosts, &s, &out); err == nil {
+		t.Error("copy-state should refuse to run without a metadata DB")
+	}
+
+	s.Metadata = &RDS{}
+	if err := runCommand([]string{"copy-state"}, &DB, Hosts, &s, &out); err == nil {
+		t.Error("copy-state should refuse to copy into a DB that has instances")
+	}
+
+	DB.Delete(Instance{})
+	out.Reset()
+	if err := runCommand([]string{"copy-state", "-json"}, &DB, Hosts, &s, &out); err != nil {
+		t.Fatal("copy-state failed", err)
+	}
+	var copied map[string]int
+	json.Unmarshal(out.Bytes(), &copied)
+	if copied["instances"] != 1 || copied["quotas"] != 1 || copied["hosts"] != 0 {
+		t.Error("copy-state should copy the rows except the hosts already there and it copied", out.String())
+	}
+
+	moved := Instance{}
+	DB.Where("uuid = ?", "old_instance").First(&moved)
+	if moved.Database != "db_old" || !moved.CreatedAt.Equal(created) {
+		t.Error("The instance should be copied with its timestamps and it is", moved)
+	}
+	host := Host{}
+	DB.Where("name = ?", DefaultHostName).First(&host)
+	if host.Url == "stale.example.com" {
+		t.Error("The hosts saved from the config should be kept")
+	}
+}
+
+func TestReconcileCommand(t *testing.T) {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012"}
+	setup()
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"reconcile", "-drop-orphans"}, &DB, Hosts, &s, &out); err == nil || !strings.Contains(err.Error(), "-yes") {
+		t.Error("reconcile should not drop the orphans without -yes and it returned", err)
+	}
+
+	for name, valid := range map[string]bool{"dbabcdefghij01234": true, "db_abcdefghij0123": false, "dbabcdefghij0123": false, "dbABCDEFGHIJ01234": false} {
+		if instanceDatabaseName.MatchString(name) != valid {
+			t.Error(name, "should be an instance database:", valid)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the layout of the config file. Every value can be overridden
+// by its environment variable, named in the comments.
+type Config struct {
+	EncryptionKey string `yaml:"encryption_key"` // ENC_KEY
+	DashboardUrl  string `yaml:"dashboard_url"`  // DASHBOARD_URL
+	CatalogPath   string `yaml:"catalog_path"`   // CATALOG_PATH
+
+	Listen ListenConfig `yaml:"listen"`
+
+	// Where the broker keeps its state, the database when empty
+	Metadata DatabaseConfig `yaml:"metadata"`
+	// The default host, and the broker DB without metadata
+	Database DatabaseConfig `yaml:"database"`
+
+	Hosts             []HostConfig `yaml:"hosts"`              // SHARED_HOSTS, as JSON
+	PlacementStrategy string       `yaml:"placement_strategy"` // PLACEMENT_STRATEGY
+
+	Auth     AuthConfig     `yaml:"auth"`
+	TLS      TLSConfig      `yaml:"tls"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Jobs     JobsConfig     `yaml:"jobs"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+}
+
+type ListenConfig struct {
+	Host string          `yaml:"host"` // HOST
+	Port string          `yaml:"port"` // PORT
+	TLS  ListenTLSConfig `yaml:"tls"`
+}
+
+// ListenTLSConfig serves the API over HTTPS when there is a certificate
+type ListenTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`      // TLS_CERT_FILE
+	KeyFile      string `yaml:"key_file"`       // TLS_KEY_FILE
+	ClientCAFile string `yaml:"client_ca_file"` // TLS_CLIENT_CA_FILE
+	// basic, certificate or both
+	ClientAuth  string   `yaml:"client_auth"`  // TLS_CLIENT_AUTH
+	ClientNames []string `yaml:"client_names"` // TLS_CLIENT_NAMES, comma separated
+}
+
+type DatabaseConfig struct {
+	Url      string `yaml:"url" json:"url"`           // DB_URL
+	Port     string `yaml:"port" json:"port"`         // DB_PORT
+	DbName   string `yaml:"db_name" json:"db_name"`   // DB_NAME
+	Username string `yaml:"username" json:"username"` // DB_USER
+	Password string `yaml:"password" json:"password"` // DB_PASS
+	Sslmode  string `yaml:"sslmode" json:"sslmode"`   // DB_SSLMODE
+
+	SslRootCert   string `yaml:"sslrootcert" json:"sslrootcert"`         // DB_SSLROOTCERT
+	SslCert       string `yaml:"sslcert" json:"sslcert"`                 // DB_SSLCERT
+	SslKey        string `yaml:"sslkey" json:"sslkey"`                   // DB_SSLKEY
+	SslServerName string `yaml:"ssl_server_name" json:"ssl_server_name"` // DB_SSL_SERVER_NAME
+}
+
+type HostConfig struct {
+	Name           string `yaml:"name" json:"name"`
+	DatabaseConfig `yaml:",inline"`
+	Plans          []string `yaml:"plans" json:"plans"`
+}
+
+type AuthConfig struct {
+	Credentials     []Credential `yaml:"credentials"`
+	CredentialsFile string       `yaml:"credentials_file"` // AUTH_CREDENTIALS_FILE
+	JWT             JWTConfig    `yaml:"jwt"`
+
+	// Plaintext, before credentials had roles
+	Username        string `yaml:"username"`         // AUTH_USER
+	Password        string `yaml:"password"`         // AUTH_PASS
+	MetricsUsername string `yaml:"metrics_username"` // METRICS_USER
+	MetricsPassword string `yaml:"metrics_password"` // METRICS_PASS
+}
+
+// JWTConfig lets the admin API take bearer tokens from an issuer like UAA
+type JWTConfig struct {
+	JWKSURL        string   `yaml:"jwks_url"`         // ADMIN_JWKS_URL
+	Issuer         string   `yaml:"issuer"`           // ADMIN_JWT_ISSUER
+	Audience       string   `yaml:"audience"`         // ADMIN_JWT_AUDIENCE
+	AdminScopes    []string `yaml:"admin_scopes"`     // ADMIN_JWT_ADMIN_SCOPES, comma separated
+	ReadOnlyScopes []string `yaml:"read_only_scopes"` // ADMIN_JWT_READ_ONLY_SCOPES, comma separated
+	CacheTTL       string   `yaml:"cache_ttl"`        // ADMIN_JWKS_CACHE_TTL
+}
+
+type TLSConfig struct {
+	// The CA of the host certificates, handed to apps
+	CACertFile string `yaml:"ca_cert_file"` // DB_CA_CERT_FILE
+}
+
+type LimitsConfig struct {
+	RequestsPerSecond       string `yaml:"requests_per_second"`       // RATE_LIMIT_PER_SECOND
+	Burst                   string `yaml:"burst"`                     // RATE_LIMIT_BURST
+	MaxConcurrentProvisions string `yaml:"max_concurrent_provisions"` // MAX_CONCURRENT_PROVISIONS
+}
+
+type JobsConfig struct {
+	StorageCheckInterval       string `yaml:"storage_check_interval"`       // STORAGE_CHECK_INTERVAL
+	StorageWarnPercent         string `yaml:"storage_warn_percent"`         // STORAGE_WARN_PERCENT
+	CredentialRotationInterval string `yaml:"credential_rotation_interval"` // CREDENTIAL_ROTATION_INTERVAL
+	CredentialRotationOverlap  string `yaml:"credential_rotation_overlap"`  // CREDENTIAL_ROTATION_OVERLAP
+}
+
+type TimeoutsConfig struct {
+	DBConnect string `yaml:"db_connect"` // DB_CONNECT_TIMEOUT
+	Shutdown  string `yaml:"shutdown"`   // SHUTDOWN_TIMEOUT
+}
+
+// ConfigErrors lists everything wrong with a config
+type ConfigErrors []string
+
+func (ce ConfigErrors) Error() string {
+	return "Invalid settings:\n  " + strings.Join(ce, "\n  ")
+}
+
+func (ce *ConfigErrors) add(format string, args ...interface{}) {
+	*ce = append(*ce, fmt.Sprintf(format, args...))
+}
+
+// LoadSettings reads the config file at CONFIG_FILE, if any, applies the
+// environment on top of it and validates the result
+func LoadSettings() (*Settings, error) {
+	config, err := LoadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.ApplyEnv(); err != nil {
+		return nil, err
+	}
+
+	return config.Settings()
+}
+
+// LoadConfig reads a config file. An empty path gives an empty config.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the config file: %s", err)
+	}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("Error parsing the config file %s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+// ApplyEnv overrides the config with the environment variables that are set
+func (c *Config) ApplyEnv() error {
+	vars := []struct {
+		name  string
+		value *string
+	}{
+		{"ENC_KEY", &c.EncryptionKey},
+		{"DASHBOARD_URL", &c.DashboardUrl},
+		{"CATALOG_PATH", &c.CatalogPath},
+		{"HOST", &c.Listen.Host},
+		{"PORT", &c.Listen.Port},
+		{"TLS_CERT_FILE", &c.Listen.TLS.CertFile},
+		{"TLS_KEY_FILE", &c.Listen.TLS.KeyFile},
+		{"TLS_CLIENT_CA_FILE", &c.Listen.TLS.ClientCAFile},
+		{"TLS_CLIENT_AUTH", &c.Listen.TLS.ClientAuth},
+		{"METADATA_DB_URL", &c.Metadata.Url},
+		{"METADATA_DB_PORT", &c.Metadata.Port},
+		{"METADATA_DB_NAME", &c.Metadata.DbName},
+		{"METADATA_DB_USER", &c.Metadata.Username},
+		{"METADATA_DB_PASS", &c.Metadata.Password},
+		{"METADATA_DB_SSLMODE", &c.Metadata.Sslmode},
+		{"METADATA_DB_SSLROOTCERT", &c.Metadata.SslRootCert},
+		{"METADATA_DB_SSLCERT", &c.Metadata.SslCert},
+		{"METADATA_DB_SSLKEY", &c.Metadata.SslKey},
+		{"METADATA_DB_SSL_SERVER_NAME", &c.Metadata.SslServerName},
+		{"DB_URL", &c.Database.Url},
+		{"DB_PORT", &c.Database.Port},
+		{"DB_NAME", &c.Database.DbName},
+		{"DB_USER", &c.Database.Username},
+		{"DB_PASS", &c.Database.Password},
+		{"DB_SSLMODE", &c.Database.Sslmode},
+		{"DB_SSLROOTCERT", &c.Database.SslRootCert},
+		{"DB_SSLCERT", &c.Database.SslCert},
+		{"DB_SSLKEY", &c.Database.SslKey},
+		{"DB_SSL_SERVER_NAME", &c.Database.SslServerName},
+		{"PLACEMENT_STRATEGY", &c.PlacementStrategy},
+		{"AUTH_CREDENTIALS_FILE", &c.Auth.CredentialsFile},
+		{"ADMIN_JWKS_URL", &c.Auth.JWT.JWKSURL},
+		{"ADMIN_JWT_ISSUER", &c.Auth.JWT.Issuer},
+		{"ADMIN_JWT_AUDIENCE", &c.Auth.JWT.Audience},
+		{"ADMIN_JWKS_CACHE_TTL", &c.Auth.JWT.CacheTTL},
+		{"AUTH_USER", &c.Auth.Username},
+		{"AUTH_PASS", &c.Auth.Password},
+		{"METRICS_USER", &c.Auth.MetricsUsername},
+		{"METRICS_PASS", &c.Auth.MetricsPassword},
+		{"DB_CA_CERT_FILE", &c.TLS.CACertFile},
+		{"RATE_LIMIT_PER_SECOND", &c.Limits.RequestsPerSecond},
+		{"RATE_LIMIT_BURST", &c.Limits.Burst},
+		{"MAX_CONCURRENT_PROVISIONS", &c.Limits.MaxConcurrentProvisions},
+		{"STORAGE_CHECK_INTERVAL", &c.Jobs.StorageCheckInterval},
+		{"STORAGE_WARN_PERCENT", &c.Jobs.StorageWarnPercent},
+		{"CREDENTIAL_ROTATION_INTERVAL", &c.Jobs.CredentialRotationInterval},
+		{"CREDENTIAL_ROTATION_OVERLAP", &c.Jobs.CredentialRotationOverlap},
+		{"DB_CONNECT_TIMEOUT", &c.Timeouts.DBConnect},
+		{"SHUTDOWN_TIMEOUT", &c.Timeouts.Shutdown},
+	}
+	for _, v := range vars {
+		if value, ok := os.LookupEnv(v.name); ok {
+			*v.value = value
+		}
+	}
+
+	lists := []struct {
+		name  string
+		value *[]string
+	}{
+		{"TLS_CLIENT_NAMES", &c.Listen.TLS.ClientNames},
+		{"ADMIN_JWT_ADMIN_SCOPES", &c.Auth.JWT.AdminScopes},
+		{"ADMIN_JWT_READ_ONLY_SCOPES", &c.Auth.JWT.ReadOnlyScopes},
+	}
+	for _, l := range lists {
+		if value := os.Getenv(l.name); value != "" {
+			*l.value = strings.Split(value, ",")
+		}
+	}
+
+	if hosts := os.Getenv("SHARED_HOSTS"); hosts != "" {
+		c.Hosts = nil
+		if err := json.Unmarshal([]byte(hosts), &c.Hosts); err != nil {
+			return fmt.Errorf("Invalid SHARED_HOSTS: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// The sslmodes lib/pq knows
+var validSslmodes = map[string]bool{
+	"disable": true, "require": true, "verify-ca": true, "verify-full": true,
+}
+
+// Settings fills in the defaults and checks the config. The error lists
+// every problem found.
+func (c *Config) Settings() (*Settings, error) {
+	var errs ConfigErrors
+	settings := &Settings{
+		EncryptionKey:     c.EncryptionKey,
+		DashboardUrl:      c.DashboardUrl,
+		PlacementStrategy: c.PlacementStrategy,
+		Auth: AuthSettings{
+			Credentials:     c.Auth.Credentials,
+			CredentialsFile: c.Auth.CredentialsFile,
+			Username:        c.Auth.Username,
+			Password:        c.Auth.Password,
+			MetricsUsername: c.Auth.MetricsUsername,
+			MetricsPassword: c.Auth.MetricsPassword,
+		},
+	}
+
+	switch len(c.EncryptionKey) {
+	case 0:
+		errs.add("encryption_key (ENC_KEY) is required")
+	case 16, 24, 32:
+	default:
+		errs.add("encryption_key (ENC_KEY) has to be 16, 24 or 32 bytes long")
+	}
+
+	for i := range c.Auth.Credentials {
+		if err := c.Auth.Credentials[i].Check(); err != nil {
+			errs.add("auth.credentials[%d]: %s", i, err)
+		}
+	}
+	if c.Auth.CredentialsFile != "" {
+		if _, err := LoadCredentialsFile(c.Auth.CredentialsFile); err != nil {
+			errs.add("auth.credentials_file (AUTH_CREDENTIALS_FILE): %s", err)
+		}
+	}
+	settings.Auth.JWT = c.Auth.JWT.settings(&errs)
+	legacy := c.Auth.Username != "" || c.Auth.Password != ""
+	if legacy && (c.Auth.Username == "" || c.Auth.Password == "") {
+		errs.add("auth.username and auth.password (AUTH_USER and AUTH_PASS) go together")
+	}
+	// Not needed when the platform authenticates with its certificate only
+	if !legacy && len(c.Auth.Credentials) == 0 && c.Auth.CredentialsFile == "" && c.Listen.TLS.ClientAuth != ClientAuthCertificate {
+		errs.add("auth.credentials, auth.credentials_file or auth.username and auth.password (AUTH_USER and AUTH_PASS) are required")
+	}
+	if (c.Auth.MetricsUsername == "") != (c.Auth.MetricsPassword == "") {
+		errs.add("auth.metrics_username and auth.metrics_password (METRICS_USER and METRICS_PASS) go together")
+	}
+
+	port := c.Listen.Port
+	if port == "" {
+		port = "3000"
+	}
+	if !validPort(port) {
+		errs.add("listen.port (PORT) %q is not a port", port)
+	}
+	settings.Listen = c.Listen.Host + ":" + port
+	settings.ServerTLS = c.Listen.TLS.settings(&errs)
+
+	if c.Metadata != (DatabaseConfig{}) {
+		settings.Metadata = c.Metadata.rds("metadata", &RDS{Sslmode: "verify-ca"}, &errs)
+		if c.Metadata.Url == "" {
+			errs.add("metadata.url (METADATA_DB_URL) is required with the other metadata settings")
+		}
+	}
+
+	// With its own metadata DB the broker can do without a default host,
+	// as long as there are others
+	settings.Hosts = []HostSettings{}
+	if c.Database.Url != "" || settings.Metadata == nil {
+		settings.Rds = c.Database.rds("database", &RDS{Sslmode: "verify-ca"}, &errs)
+		settings.Hosts = append(settings.Hosts, HostSettings{Name: DefaultHostName, Rds: settings.Rds})
+		if c.Database.Url == "" {
+			errs.add("database.url (DB_URL) is required")
+		}
+	} else if c.Database != (DatabaseConfig{}) {
+		errs.add("database.url (DB_URL) is required with the other database settings")
+	} else if len(c.Hosts) == 0 {
+		errs.add("database.url (DB_URL) or hosts (SHARED_HOSTS) are required, the instances need a host")
+	}
+
+	if c.PlacementStrategy != "" && !ValidPlacementStrategy(c.PlacementStrategy) {
+		errs.add("placement_strategy (PLACEMENT_STRATEGY) %q is unknown", c.PlacementStrategy)
+	}
+
+	// The hosts get the sslmode and CA bundle of the database unless they
+	// have their own
+	defaults := &RDS{Sslmode: settings.HostDefaults().Sslmode, SslRootCert: settings.HostDefaults().SslRootCert}
+	if !validSslmodes[defaults.Sslmode] {
+		defaults.Sslmode = "verify-ca"
+	}
+	names := map[string]bool{DefaultHostName: true}
+	for i, hc := range c.Hosts {
+		field := fmt.Sprintf("hosts[%d]", i)
+		if hc.Name == "" || hc.Url == "" {
+			errs.add("%s needs a name and an url", field)
+		} else if names[hc.Name] {
+			errs.add("%s: the name %s is already used", field, hc.Name)
+		}
+		names[hc.Name] = true
+
+		rds := hc.rds(field, defaults, &errs)
+		settings.Hosts = append(settings.Hosts, HostSettings{Name: hc.Name, Rds: rds, Plans: hc.Plans})
+	}
+
+	catalog := BuildCatalog()
+	if c.CatalogPath != "" {
+		loaded, err := LoadCatalog(c.CatalogPath)
+		if err != nil {
+			errs.add("catalog_path (CATALOG_PATH): %s", err)
+		}
+		settings.Catalog = loaded
+		catalog = loaded
+	}
+	plans := checkCatalog(catalog, &errs)
+	for i, hc := range c.Hosts {
+		for _, id := range hc.Plans {
+			if !plans[id] {
+				errs.add("hosts[%d].plans: %s is not a plan of the catalog", i, id)
+			}
+		}
+	}
+
+	if c.TLS.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CACertFile)
+		if err != nil {
+			errs.add("tls.ca_cert_file (DB_CA_CERT_FILE): %s", err)
+		}
+		settings.CACertificate = string(pem)
+	}
+
+	settings.StorageCheckInterval = parseDuration(c.Jobs.StorageCheckInterval, 10*time.Minute, "jobs.storage_check_interval (STORAGE_CHECK_INTERVAL)", &errs)
+	settings.RotationInterval = parseDuration(c.Jobs.CredentialRotationInterval, 0, "jobs.credential_rotation_interval (CREDENTIAL_ROTATION_INTERVAL)", &errs)
+	settings.RotationOverlap = parseDuration(c.Jobs.CredentialRotationOverlap, 24*time.Hour, "jobs.credential_rotation_overlap (CREDENTIAL_ROTATION_OVERLAP)", &errs)
+	settings.DBConnectTimeout = parseDuration(c.Timeouts.DBConnect, 2*time.Minute, "timeouts.db_connect (DB_CONNECT_TIMEOUT)", &errs)
+	settings.ShutdownTimeout = parseDuration(c.Timeouts.Shutdown, 30*time.Second, "timeouts.shutdown (SHUTDOWN_TIMEOUT)", &errs)
+	if settings.StorageCheckInterval == 0 {
+		errs.add("jobs.storage_check_interval (STORAGE_CHECK_INTERVAL) has to be more than 0")
+	}
+
+	settings.Limits = c.Limits.settings(&errs)
+
+	settings.StorageWarnPercent = 80
+	if c.Jobs.StorageWarnPercent != "" {
+		percent, err := strconv.ParseInt(c.Jobs.StorageWarnPercent, 10, 64)
+		if err != nil || percent < 1 || percent > 100 {
+			errs.add("jobs.storage_warn_percent (STORAGE_WARN_PERCENT) has to be a number from 1 to 100")
+		}
+		settings.StorageWarnPercent = percent
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return settings, nil
+}
+
+// checkCatalog checks the broker settings of the plans and returns their ids
+func checkCatalog(catalog []Service, errs *ConfigErrors) map[string]bool {
+	plans := map[string]bool{}
+	for _, service := range catalog {
+		for _, plan := range service.Plans {
+			field := fmt.Sprintf("catalog plan %s", plan.Id)
+			if plans[plan.Id] {
+				errs.add("%s: the id is already used", field)
+			}
+			plans[plan.Id] = true
+
+			if err := plan.Profile.Check(); err != nil {
+				errs.add("%s: profile: %s", field, err)
+			}
+			for _, credential := range plan.Credentials {
+				if !credentialFields[credential] {
+					errs.add("%s: credentials: %s is not a credential field", field, credential)
+				}
+			}
+		}
+	}
+	return plans
+}
+
+// settings checks the limits, 0 turning one off
+func (lc LimitsConfig) settings(errs *ConfigErrors) LimitSettings {
+	ls := LimitSettings{RequestsPerSecond: 10, Burst: 50, MaxConcurrentProvisions: 5}
+
+	if lc.RequestsPerSecond != "" {
+		rate, err := strconv.ParseFloat(lc.RequestsPerSecond, 64)
+		if err != nil || rate < 0 {
+			errs.add("limits.requests_per_second (RATE_LIMIT_PER_SECOND) has to be a number from 0")
+		}
+		ls.RequestsPerSecond = rate
+	}
+	counts := []struct {
+		value string
+		field string
+		count *int
+	}{
+		{lc.Burst, "limits.burst (RATE_LIMIT_BURST)", &ls.Burst},
+		{lc.MaxConcurrentProvisions, "limits.max_concurrent_provisions (MAX_CONCURRENT_PROVISIONS)", &ls.MaxConcurrentProvisions},
+	}
+	for _, c := range counts {
+		if c.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c.value)
+		if err != nil || n < 0 {
+			errs.add("%s has to be a whole number from 0", c.field)
+		}
+		*c.count = n
+	}
+
+	return ls
+}
+
+// settings checks the issuer of the admin API tokens
+func (jc JWTConfig) settings(errs *ConfigErrors) JWTSettings {
+	js := JWTSettings{
+		JWKSURL:        jc.JWKSURL,
+		Issuer:         jc.Issuer,
+		Audience:       jc.Audience,
+		AdminScopes:    jc.AdminScopes,
+		ReadOnlyScopes: jc.ReadOnlyScopes,
+		CacheTTL:       parseDuration(jc.CacheTTL, time.Hour, "auth.jwt.cache_ttl (ADMIN_JWKS_CACHE_TTL)", errs),
+	}
+	if js.AdminScopes == nil {
+		js.AdminScopes = []string{"rds-broker.admin"}
+	}
+	if js.ReadOnlyScopes == nil {
+		js.ReadOnlyScopes = []string{"rds-broker.read"}
+	}
+	if jc.JWKSURL == "" {
+		return js
+	}
+
+	// Over plain http anyone on the way could hand out their own keys
+	if u, err := url.Parse(jc.JWKSURL); err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+		errs.add("auth.jwt.jwks_url (ADMIN_JWKS_URL) %q is not an https URL, or http on the loopback", jc.JWKSURL)
+	}
+	if jc.Issuer == "" {
+		errs.add("auth.jwt.issuer (ADMIN_JWT_ISSUER) is required with a jwks_url")
+	}
+	return js
+}
+
+// settings checks the TLS of the API
+func (lc ListenTLSConfig) settings(errs *ConfigErrors) ServerTLSSettings {
+	ts := ServerTLSSettings{
+		CertFile:    lc.CertFile,
+		KeyFile:     lc.KeyFile,
+		ClientAuth:  lc.ClientAuth,
+		ClientNames: lc.ClientNames,
+	}
+	if ts.ClientAuth == "" {
+		ts.ClientAuth = ClientAuthBasic
+	}
+
+	if (lc.CertFile == "") != (lc.KeyFile == "") {
+		errs.add("listen.tls.cert_file and listen.tls.key_file (TLS_CERT_FILE and TLS_KEY_FILE) go together")
+	} else if lc.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile); err != nil {
+			errs.add("listen.tls.cert_file (TLS_CERT_FILE): %s", err)
+		}
+	}
+
+	if lc.ClientCAFile != "" {
+		if lc.CertFile == "" {
+			errs.add("listen.tls.client_ca_file (TLS_CLIENT_CA_FILE) needs a listen.tls.cert_file")
+		}
+		pool, err := LoadCertPool(lc.ClientCAFile)
+		if err != nil {
+			errs.add("listen.tls.client_ca_file (TLS_CLIENT_CA_FILE): %s", err)
+		}
+		ts.ClientCAs = pool
+	}
+
+	switch ts.ClientAuth {
+	case ClientAuthBasic:
+	case ClientAuthCertificate, ClientAuthBoth:
+		if lc.ClientCAFile == "" {
+			errs.add("listen.tls.client_auth (TLS_CLIENT_AUTH) %s needs a listen.tls.client_ca_file", ts.ClientAuth)
+		}
+	default:
+		errs.add("listen.tls.client_auth (TLS_CLIENT_AUTH) %q is not basic, certificate or both", ts.ClientAuth)
+	}
+
+	return ts
+}
+
+// rds checks the connection settings of the database at field. The sslmode
+// and CA bundle of defaults are used when dc has none.
+func (dc DatabaseConfig) rds(field string, defaults *RDS, errs *ConfigErrors) *RDS {
+	rds := &RDS{
+		Url:      dc.Url,
+		Port:     dc.Port,
+		DbName:   dc.DbName,
+		Username: dc.Username,
+		Password: dc.Password,
+		Sslmode:  dc.Sslmode,
+
+		SslRootCert:   dc.SslRootCert,
+		SslCert:       dc.SslCert,
+		SslKey:        dc.SslKey,
+		SslServerName: dc.SslServerName,
+	}
+	if rds.Port == "" {
+		rds.Port = "5432"
+	}
+	if rds.Sslmode == "" {
+		rds.Sslmode = defaults.Sslmode
+	}
+	if rds.SslRootCert == "" {
+		rds.SslRootCert = defaults.SslRootCert
+	}
+
+	if !validPort(rds.Port) {
+		errs.add("%s.port %q is not a port", field, rds.Port)
+	}
+	if !validSslmodes[rds.Sslmode] {
+		errs.add("%s.sslmode %q is unknown", field, rds.Sslmode)
+	}
+
+	// An inherited CA bundle was checked with the database
+	if dc.SslRootCert != "" {
+		if _, err := ioutil.ReadFile(rds.SslRootCert); err != nil {
+			errs.add("%s.sslrootcert: %s", field, err)
+		}
+	}
+	if (rds.SslCert == "") != (rds.SslKey == "") {
+		errs.add("%s.sslcert and %s.sslkey go together", field, field)
+	} else if rds.SslCert != "" {
+		if _, err := ioutil.ReadFile(rds.SslCert); err != nil {
+			errs.add("%s.sslcert: %s", field, err)
+		}
+		if info, err := os.Stat(rds.SslKey); err != nil {
+			errs.add("%s.sslkey: %s", field, err)
+		} else if info.Mode().Perm()&077 != 0 {
+			errs.add("%s.sslkey %s can't be readable by the group or others", field, rds.SslKey)
+		}
+	}
+	if rds.SslServerName != "" && rds.Sslmode != "verify-full" {
+		errs.add("%s.ssl_server_name only applies with the sslmode verify-full", field)
+	}
+
+	return rds
+}
+
+// isLoopback reports whether host names this machine
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// parseDuration returns the duration in value, or fallback when it is empty
+func parseDuration(value string, fallback time.Duration, field string, errs *ConfigErrors) time.Duration {
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		errs.add("%s %q is not a duration", field, value)
+		return fallback
+	}
+	return duration
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "rds-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettings(t *testing.T) {
+	catalog := writeFile(t, "catalog.yml", `
+services:
+- id: the-service
+  name: postgres
+  bindable: true
+  plans:
+  - id: the-plan
+    name: small
+    storage_limit_mb: 512
+    profile:
+      connection_limit: 5
+    credentials: [port]
+`)
+	config := writeFile(t, "config.yml", `
+encryption_key: "12345678901234567890123456789012"
+catalog_path: `+catalog+`
+database:
+  url: db.example.com
+  db_name: broker
+  username: broker
+  password: file-password
+hosts:
+- name: shared2
+  url: shared2.example.com
+  port: 5433
+  plans: [the-plan]
+auth:
+  username: broker
+  password: secret
+jobs:
+  storage_check_interval: 5m
+  storage_warn_percent: 90
+`)
+
+	os.Setenv("CONFIG_FILE", config)
+	os.Setenv("DB_PASS", "env-password")
+	defer os.Unsetenv("CONFIG_FILE")
+	defer os.Unsetenv("DB_PASS")
+
+	s, err := LoadSettings()
+	if err != nil {
+		t.Fatal("The config should be valid", err)
+	}
+
+	if s.Rds.Password != "env-password" {
+		t.Error("The environment should override the file and the password is", s.Rds.Password)
+	}
+	if s.Rds.Sslmode != "verify-ca" || s.Rds.Port != "5432" {
+		t.Error("The database should get the default port and sslmode and it got", s.Rds.Port, s.Rds.Sslmode)
+	}
+	if len(s.Hosts) != 2 || s.Hosts[1].Name != "shared2" || s.Hosts[1].Rds.Port != "5433" || s.Hosts[1].Plans[0] != "the-plan" {
+		t.Error("The hosts should be the default one and shared2 and they are", s.Hosts)
+	}
+	if s.StorageCheckInterval != 5*time.Minute || s.StorageWarnPercent != 90 || s.ShutdownTimeout != 30*time.Second {
+		t.Error("The jobs should be scheduled as configured")
+	}
+	if len(s.Catalog) != 1 || s.Catalog[0].Plans[0].StorageLimitMB != 512 || s.Catalog[0].Plans[0].Profile.ConnectionLimit != 5 {
+		t.Error("The catalog should be read from its file and it is", s.Catalog)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	config := Config{
+		EncryptionKey: "short",
+		Database:      DatabaseConfig{Url: "db.example.com", Port: "port", Sslmode: "sometimes"},
+		Hosts:         []HostConfig{{Name: "default", DatabaseConfig: DatabaseConfig{Url: "other.example.com"}}},
+		Jobs:          JobsConfig{StorageCheckInterval: "often", StorageWarnPercent: "120"},
+		TLS:           TLSConfig{CACertFile: "/does/not/exist"},
+	}
+
+	_, err := config.Settings()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatal("An invalid config should return ConfigErrors and it returned", err)
+	}
+
+	expected := []string{"encryption_key", "auth.username", "database.port", "database.sslmode", "hosts[0]", "storage_check_interval", "storage_warn_percent", "ca_cert_file"}
+	for _, field := range expected {
+		if !strings.Contains(errs.Error(), field) {
+			t.Error("The errors should mention", field, "and they are", errs.Error())
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Error("Every error should be reported once and they are", errs.Error())
+	}
+}
+
+func TestCatalogErrors(t *testing.T) {
+	catalog := writeFile(t, "catalog.yml", `
+services:
+- id: the-service
+  name: postgres
+  plans:
+  - id: the-plan
+    name: small
+    credentials: [port, password]
+    profile:
+      statement_timeout: "0; RESET ALL"
+  - id: the-plan
+    name: large
+`)
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		CatalogPath:   catalog,
+		Database:      DatabaseConfig{Url: "db.example.com"},
+		Auth:          AuthConfig{Username: "broker", Password: "secret"},
+		Hosts:         []HostConfig{{Name: "shared", Url: "shared.example.com", Plans: []string{"the-plan", "no-plan"}}},
+	}
+
+	_, err := config.Settings()
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatal("The catalog should be checked and it returned", err)
+	}
+	expected := []string{"statement_timeout", "password is not a credential field", "the id is already used", "no-plan is not a plan"}
+	for _, message := range expected {
+		if !strings.Contains(errs.Error(), message) {
+			t.Error("The errors should mention", message, "and they are", errs.Error())
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Error("Every error should be reported once and they are", errs.Error())
+	}
+}
+
+func TestHostPlansUseTheDefaultCatalog(t *testing.T) {
+	plan := BuildCatalog()[0].Plans[0].Id
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		Database:      DatabaseConfig{Url: "db.example.com"},
+		Auth:          AuthConfig{Username: "broker", Password: "secret"},
+		Hosts:         []HostConfig{{Name: "shared", Url: "shared.example.com", Plans: []string{plan}}},
+	}
+
+	if _, err := config.Settings(); err != nil {
+		t.Error("A plan of the default catalog should be accepted and it returned", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeFile(t, "config.yml", "encryption_kee: typo\n")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("Unknown keys in the config file should be an error")
+	}
+}
+
+func TestDatabaseTLSConfig(t *testing.T) {
+	ca := writeFile(t, "rds-ca.pem", "ca")
+	cert := writeFile(t, "client.crt", "cert")
+	key := writeFile(t, "client.key", "key")
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		Auth:          AuthConfig{Username: "broker", Password: "secret"},
+		Database:      DatabaseConfig{Url: "10.0.0.1", Sslmode: "verify-full", SslRootCert: ca, SslCert: cert, SslKey: key, SslServerName: "db.example.com"},
+		Hosts:         []HostConfig{{Name: "shared2", DatabaseConfig: DatabaseConfig{Url: "shared2.example.com"}}},
+	}
+
+	s, err := config.Settings()
+	if err != nil {
+		t.Fatal("The config should be valid", err)
+	}
+	if s.Rds.SslRootCert != ca || s.Rds.SslKey != key || s.Rds.SslServerName != "db.example.com" {
+		t.Error("The database should get its TLS files and server name and it got", s.Rds)
+	}
+	if host := s.Hosts[1].Rds; host.Sslmode != "verify-full" || host.SslRootCert != ca || host.SslCert != "" {
+		t.Error("The hosts should get the sslmode and CA bundle of the database but not its client certificate and they got", host)
+	}
+
+	os.Chmod(key, 0644)
+	config.Database.SslServerName = ""
+	config.Hosts[0].SslKey = key
+	config.Hosts[0].Sslmode = "verify-ca"
+	config.Hosts[0].SslServerName = "shared.example.com"
+
+	_, err = config.Settings()
+	expected := []string{"database.sslkey", "hosts[0].sslcert and hosts[0].sslkey", "hosts[0].ssl_server_name"}
+	for _, field := range expected {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Error("The errors should mention", field, "and they are", err)
+		}
+	}
+}
+
+func TestMetadataConfig(t *testing.T) {
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		Auth:          AuthConfig{Username: "broker", Password: "secret"},
+		Metadata:      DatabaseConfig{Url: "state.example.com", DbName: "broker", Sslmode: "require"},
+		Hosts:         []HostConfig{{Name: "shared2", DatabaseConfig: DatabaseConfig{Url: "shared2.example.com"}}},
+	}
+
+	s, err := config.Settings()
+	if err != nil {
+		t.Fatal("A metadata DB with named hosts only should be valid", err)
+	}
+	if s.MetadataRds().Url != "state.example.com" || s.Rds != nil {
+		t.Error("The state should be kept in the metadata DB, without a default host, and it is kept in", s.MetadataRds())
+	}
+	if len(s.Hosts) != 1 || s.Hosts[0].Rds.Sslmode != "require" {
+		t.Error("The hosts should get the sslmode of the metadata DB without a default host and they are", s.Hosts)
+	}
+
+	config.Database = DatabaseConfig{Url: "db.example.com"}
+	s, err = config.Settings()
+	if err != nil {
+		t.Fatal("A metadata DB with a default host should be valid", err)
+	}
+	if s.MetadataRds().Url != "state.example.com" || s.Rds.Url != "db.example.com" || s.Hosts[0].Name != DefaultHostName {
+		t.Error("The default host and the metadata DB should be apart and they are", s.Rds, s.MetadataRds())
+	}
+
+	config.Metadata.Url = ""
+	config.Database = DatabaseConfig{}
+	config.Hosts = nil
+	_, err = config.Settings()
+	expected := []string{"metadata.url", "database.url"}
+	for _, field := range expected {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Error("The errors should mention", field, "and they are", err)
+		}
+	}
+}
+
+func TestListenTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, "broker")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		Database:      DatabaseConfig{Url: "db.example.com"},
+		Listen: ListenConfig{TLS: ListenTLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: writeFile(t, "clients.pem", string(caPEM)),
+			ClientAuth:   ClientAuthCertificate,
+		}},
+	}
+
+	s, err := config.Settings()
+	if err != nil {
+		t.Fatal("Certificate auth should not need basic credentials", err)
+	}
+	if s.ServerTLS.ClientCAs == nil || s.ServerTLS.ClientAuth != ClientAuthCertificate {
+		t.Error("The client CAs should be loaded and they are", s.ServerTLS)
+	}
+
+	config.Listen.TLS = ListenTLSConfig{KeyFile: keyFile, ClientAuth: "sometimes"}
+	_, err = config.Settings()
+	expected := []string{"auth.username", "listen.tls.cert_file and listen.tls.key_file", "listen.tls.client_auth"}
+	for _, field := range expected {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Error("The errors should mention", field, "and they are", err)
+		}
+	}
+}
+
+func TestCredentialErrors(t *testing.T) {
+	config := Config{
+		EncryptionKey: "12345678901234567890123456789012",
+		Database:      DatabaseConfig{Url: "db.example.com"},
+		Auth: AuthConfig{
+			Credentials: []Credential{
+				{Username: "cf", PasswordHash: "plaintext", Role: RolePlatform},
+				{Username: "ops", PasswordHash: "$2a$04$aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Role: "root"},
+			},
+			CredentialsFile: "/does/not/exist",
+			JWT:             JWTConfig{JWKSURL: "uaa.example.com/token_keys"},
+			Username:        "legacy",
+		},
+	}
+
+	_, err := config.Settings()
+	expected := []string{"auth.credentials[0]", "auth.credentials[1]", "auth.credentials_file", "auth.jwt.jwks_url", "auth.jwt.issuer", "auth.username and auth.password"}
+	for _, field := range expected {
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Error("The errors should mention", field, "and they are", err)
+		}
+	}
+	for jwksURL, valid := range map[string]bool{
+		"https://uaa.example.com/token_keys": true,
+		"http://127.0.0.1:8080/token_keys":   true,
+		"http://localhost/token_keys":        true,
+		"http://uaa.example.com/token_keys":  false,
+	} {
+		var errs ConfigErrors
+		(JWTConfig{JWKSURL: jwksURL, Issuer: "uaa"}).settings(&errs)
+		if (len(errs) == 0) != valid {
+			t.Error(jwksURL, "should be a valid jwks_url:", valid, "and the errors are", errs)
+		}
+	}
+}
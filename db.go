@@ -2,11 +2,17 @@ package main
 
 import (
 	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/martini-contrib/render"
 	_ "github.com/mattn/go-sqlite3"
 
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
 )
 
 // Connection string parameters for Postgres - http://godoc.org/github.com/lib/pq, if you are using another
@@ -22,45 +28,216 @@ import (
 //   Valid SSL modes:
 //    * disable - No SSL
 //    * require - Always SSL (skip verification)
+//    * verify-ca - Always SSL (verify the certificate is signed by a trusted CA)
 //    * verify-full - Always SSL (require verification)
+// * sslrootcert - The CA bundle the server certificate is checked against
+// * sslcert, sslkey - The client certificate and its key, for servers that
+//   ask for one. The key must not be readable by others.
 
+// DB is the metadata DB, where the broker keeps its state. The databases
+// of the instances are on the hosts.
 var DB gorm.DB
 
-func DBInit(rds *RDS, env string) error {
-	var err error
+// The tables of the broker state, made by the migrations
+var metadataModels = []interface{}{Instance{}, Quota{}, StorageEvent{}, Host{}, PendingOperation{}, Binding{}}
 
+// DBInit connects to the metadata DB. The connection is retried with
+// backoff until timeout runs out, so the broker can start before its DB
+// does.
+func DBInit(rds *RDS, env string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	wait := time.Second
+
+	for {
+		var err error
+		DB, err = OpenDB(rds, env)
+		if err == nil {
+			err = DB.DB().Ping()
+			if err != nil {
+				DB.Close()
+			}
+		}
+		if err == nil {
+			break
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("Could not connect to the DB within %s: %s", timeout, Redact(err.Error()))
+		}
+
+		Log.Error("Error connecting to the DB", err, "retry_in", wait.String())
+		time.Sleep(wait)
+		if wait *= 2; wait > maxConnectWait {
+			wait = maxConnectWait
+		}
+	}
+
+	return nil
+}
+
+// The longest wait between two attempts to connect to the DB
+const maxConnectWait = 30 * time.Second
+
+// RequireDB answers 503 when the broker DB can't be reached, so the
+// platform retries later instead of the request failing halfway
+func RequireDB(r render.Render, db *gorm.DB, l *Logger) {
+	if err := db.DB().Ping(); err != nil {
+		l.Error("The DB is unavailable", err)
+		r.JSON(503, Response{"The broker database is unavailable"})
+	}
+}
+
+// OpenDB connects to the server described by rds, or to an in-memory
+// database when testing
+func OpenDB(rds *RDS, env string) (gorm.DB, error) {
 	if env == "test" {
 		// We are doing testing!
-		DB, err = gorm.Open("sqlite3", ":memory:")
-
-		log.Println("TEST")
-	} else {
-		log.Println("Connecting to DB")
-		conn := "dbname=%s user=%s password=%s host=%s sslmode=%s port=%s"
-		conn = fmt.Sprintf(conn,
-			rds.DbName,
-			rds.Username,
-			rds.Password,
-			rds.Url,
-			rds.Sslmode,
-			rds.Port)
-
-		DB, err = gorm.Open("postgres", conn)
-
-		log.Println("Connected")
-
-		// DB.LogMode(true)
-		DB.DB().SetMaxOpenConns(10)
+		Log.Info("TEST")
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err == nil {
+			// Every connection would get its own empty in-memory database
+			db.DB().SetMaxOpenConns(1)
+		}
+		return db, err
+	}
+
+	Log.Info("Connecting to DB", "host", rds.Url, "port", rds.Port, "db_name", rds.DbName, "sslmode", rds.Sslmode)
+	driver := "postgres"
+	if rds.SslServerName != "" {
+		driver = serverNameDriver
 	}
 
+	db, err := gorm.Open("postgres", driver, rds.ConnString())
 	if err != nil {
-		log.Println("Error!")
-		return err
+		return db, err
 	}
 
-	log.Println("Migrating")
-	// Automigrate!
-	DB.AutoMigrate(Instance{})
-	log.Println("Migrated")
-	return nil
+	Log.Info("Connected", "host", rds.Url)
+
+	db.SetLogger(gormLogger{Log})
+	if os.Getenv("DB_LOG_SQL") == "true" {
+		db.LogMode(true)
+	}
+	db.DB().SetMaxOpenConns(10)
+
+	return db, nil
+}
+
+// ExecLogged runs a statement, logging it when it fails
+func ExecLogged(db *gorm.DB, l *Logger, statement string) error {
+	err := db.Exec(statement).Error
+	if err != nil {
+		l.Error("Error running SQL", err, "sql", statement)
+	}
+	return err
+}
+
+// hostExec runs the statements that provision and deprovision instances and
+// manage their roles on their host. SQLite has no databases or roles, so the
+// tests replace it.
+var hostExec = ExecLogged
+
+// ConnString returns the connection string of rds. When the certificate of
+// the server is for another name than Url, host is the server name and the
+// address to dial comes first as hostaddr, for serverNameDriver.
+func (rds *RDS) ConnString() string {
+	params := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+quoteConnValue(value))
+		}
+	}
+
+	host := rds.Url
+	if rds.SslServerName != "" {
+		params = append(params, "hostaddr="+rds.Url)
+		host = rds.SslServerName
+	}
+	add("dbname", rds.DbName)
+	add("user", rds.Username)
+	add("password", rds.Password)
+	add("host", host)
+	add("port", rds.Port)
+	add("sslmode", rds.Sslmode)
+	add("sslrootcert", rds.SslRootCert)
+	add("sslcert", rds.SslCert)
+	add("sslkey", rds.SslKey)
+
+	return strings.Join(params, " ")
+}
+
+// quoteConnValue quotes value for a connection string when it is empty or
+// has spaces, quotes or backslashes
+func quoteConnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// quoteLiteral quotes value as an SQL string literal. Backslashes make it
+// an escape string, so it reads the same whatever standard_conforming_strings
+// is set to.
+func quoteLiteral(value string) string {
+	value = strings.Replace(value, `'`, `''`, -1)
+	if strings.Contains(value, `\`) {
+		return "E'" + strings.Replace(value, `\`, `\\`, -1) + "'"
+	}
+	return "'" + value + "'"
+}
+
+// serverNameDriver is the Postgres driver for the connections whose server
+// name differs from the address they dial. pq checks the certificate
+// against host, so the real address is taken out of the hostaddr parameter
+// of the connection string and dialed instead.
+const serverNameDriver = "postgres-servername"
+
+func init() {
+	sql.Register(serverNameDriver, serverNameConnector{})
+}
+
+type serverNameConnector struct{}
+
+func (serverNameConnector) Open(name string) (driver.Conn, error) {
+	addr, rest := splitHostaddr(name)
+	if addr == "" {
+		return pq.Open(name)
+	}
+	return pq.DialOpen(hostaddrDialer{addr}, rest)
+}
+
+// splitHostaddr takes the leading hostaddr parameter out of a connection
+// string
+func splitHostaddr(name string) (addr, rest string) {
+	if !strings.HasPrefix(name, "hostaddr=") {
+		return "", name
+	}
+	param := strings.TrimPrefix(name, "hostaddr=")
+	if i := strings.Index(param, " "); i >= 0 {
+		return param[:i], param[i+1:]
+	}
+	return param, ""
+}
+
+// hostaddrDialer dials addr whatever host pq asks for, on the same port
+type hostaddrDialer struct {
+	addr string
+}
+
+func (d hostaddrDialer) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, d.target(address))
+}
+
+func (d hostaddrDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, d.target(address), timeout)
+}
+
+func (d hostaddrDialer) target(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return net.JoinHostPort(d.addr, port)
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDBInitGivesUp(t *testing.T) {
+	rds := &RDS{Url: "127.0.0.1", Port: "1", DbName: "db", Username: "u", Password: "s3cret", Sslmode: "disable"}
+
+	start := time.Now()
+	err := DBInit(rds, "prod", 1500*time.Millisecond)
+	if err == nil {
+		t.Fatal("DBInit should fail when the DB can't be reached")
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("DBInit should retry before giving up and it gave up after", elapsed)
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Error("The error should not contain the password", err)
+	}
+}
+
+func TestAppFailsWithoutDB(t *testing.T) {
+	s := Settings{Rds: &RDS{Url: "127.0.0.1", Port: "1", Sslmode: "disable"}}
+	if m, err := App(&s, "prod"); m != nil || err == nil {
+		t.Error("App should return an error when the DB can't be reached")
+	}
+}
+
+func TestConnString(t *testing.T) {
+	rds := &RDS{Url: "10.0.0.1", Port: "5432", DbName: "db", Username: "u", Password: "it's a secret", Sslmode: "verify-full", SslRootCert: "/etc/rds/ca.pem"}
+	expected := `dbname=db user=u password='it\'s a secret' host=10.0.0.1 port=5432 sslmode=verify-full sslrootcert=/etc/rds/ca.pem`
+	if conn := rds.ConnString(); conn != expected {
+		t.Error("The connection string should be", expected, "and it is", conn)
+	}
+
+	rds.SslServerName = "db.example.com"
+	addr, rest := splitHostaddr(rds.ConnString())
+	if addr != "10.0.0.1" || !strings.Contains(rest, "host=db.example.com ") || strings.Contains(rest, "hostaddr") {
+		t.Error("With a server name the address should be dialed and the host be the server name and they are", addr, rest)
+	}
+}
+
+func TestServerNameDriverDialsTheAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err == nil
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	rds := &RDS{Url: "127.0.0.1", Port: port, DbName: "db", Username: "u", Sslmode: "verify-full", SslServerName: "db.invalid"}
+	db, err := OpenDB(rds, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.DB().Ping()
+
+	select {
+	case ok := <-accepted:
+		if !ok {
+			t.Error("The connection should reach the listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The driver should dial the url and not the server name")
+	}
+}
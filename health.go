@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/martini-contrib/auth"
+	"github.com/martini-contrib/render"
+
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// How long a readiness probe waits for each database
+var ReadinessTimeout = 2 * time.Second
+
+type componentStatus struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	LatencyMs float64    `json:"latency_ms"`
+	TLS       *tlsStatus `json:"tls,omitempty"`
+}
+
+// tlsStatus is the TLS configured for a connection and, when the server
+// tells, the TLS the connection actually uses
+type tlsStatus struct {
+	Sslmode    string `json:"sslmode"`
+	Verify     string `json:"verify"`
+	ServerName string `json:"server_name,omitempty"`
+	ClientCert bool   `json:"client_cert"`
+
+	Active  *bool  `json:"active,omitempty"`
+	Version string `json:"version,omitempty"`
+	Cipher  string `json:"cipher,omitempty"`
+}
+
+// newTLSStatus returns the TLS configured in rds
+func newTLSStatus(rds *RDS) *tlsStatus {
+	status := &tlsStatus{Sslmode: rds.Sslmode, ClientCert: rds.SslCert != ""}
+	switch rds.Sslmode {
+	case "disable":
+		status.Verify = "none"
+	case "verify-ca":
+		status.Verify = "ca"
+	case "verify-full":
+		status.Verify = "full"
+		status.ServerName = rds.SslServerName
+		if status.ServerName == "" {
+			status.ServerName = rds.Url
+		}
+	default:
+		// require, and pq's default
+		status.Verify = "none"
+	}
+	return status
+}
+
+// Healthz
+// URL: /healthz
+// Tells that the process is up, without looking at anything else.
+func Healthz(r render.Render) {
+	r.JSON(200, map[string]string{"status": "ok"})
+}
+
+// Readyz
+// URL: /readyz
+// Pings the metadata DB and every backing host and returns 503 when the
+// metadata DB or every host doesn't answer in time. Some hosts down is
+// "degraded": the others can still serve their instances. Every component
+// comes with its status, and for callers that can read the admin API with
+// its error and the TLS of its connection.
+func Readyz(r render.Render, db *gorm.DB, hosts *HostRegistry, s *Settings, user auth.User) {
+	type check struct {
+		db  *gorm.DB
+		rds *RDS
+	}
+	checks := map[string]check{"metadata": {db, s.MetadataRds()}}
+	names := []string{"metadata"}
+	for _, host := range hosts.All() {
+		name := "host:" + host.Name
+		checks[name] = check{host.DB, host.Rds}
+		names = append(names, name)
+	}
+
+	results := make(chan componentStatus, len(names))
+	for _, name := range names {
+		go func(name string, c check) {
+			results <- probe(name, c.db, c.rds, ReadinessTimeout)
+		}(name, checks[name])
+	}
+
+	byName := map[string]componentStatus{}
+	for range names {
+		result := <-results
+		byName[result.Name] = result
+	}
+
+	components := []componentStatus{}
+	hostsUp, hostsDown := 0, 0
+	for _, name := range names {
+		component := byName[name]
+		if user == "" {
+			component.Error, component.TLS = "", nil
+		}
+		components = append(components, component)
+		if name == "metadata" {
+			continue
+		}
+		if byName[name].Status == "ok" {
+			hostsUp++
+		} else {
+			hostsDown++
+		}
+	}
+
+	status, code := "ok", 200
+	if byName["metadata"].Status != "ok" || (hostsDown > 0 && hostsUp == 0) {
+		status, code = "unavailable", 503
+	} else if hostsDown > 0 {
+		status = "degraded"
+	}
+
+	r.JSON(code, map[string]interface{}{
+		"status":     status,
+		"components": components,
+	})
+}
+
+// probe pings db, giving up after timeout, and asks the server about the
+// TLS of the connection
+func probe(name string, db *gorm.DB, rds *RDS, timeout time.Duration) componentStatus {
+	start := time.Now()
+	type pinged struct {
+		err error
+		tls tlsStatus
+	}
+	done := make(chan pinged, 1)
+	go func() {
+		p := pinged{tls: *newTLSStatus(rds)}
+		if p.err = db.DB().Ping(); p.err == nil {
+			sslInUse(db, &p.tls)
+		}
+		done <- p
+	}()
+
+	var err error
+	status := newTLSStatus(rds)
+	select {
+	case p := <-done:
+		err, *status = p.err, p.tls
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+
+	result := componentStatus{Name: name, Status: "ok", LatencyMs: time.Since(start).Seconds() * 1000, TLS: status}
+	if err != nil {
+		result.Status = "unavailable"
+		result.Error = Redact(err.Error())
+	}
+	return result
+}
+
+// sslInUse fills in the TLS the server reports for the connection. Servers
+// without pg_stat_ssl, and the sqlite DB of the tests, leave it unknown.
+func sslInUse(db *gorm.DB, status *tlsStatus) {
+	var active bool
+	var version, cipher sql.NullString
+	row := db.DB().QueryRow("SELECT ssl, version, cipher FROM pg_stat_ssl WHERE pid = pg_backend_pid()")
+	if err := row.Scan(&active, &version, &cipher); err != nil {
+		return
+	}
+	status.Active = &active
+	status.Version = version.String
+	status.Cipher = cipher.String
+}
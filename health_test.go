@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	res, _ := doRequest(nil, "/healthz", "GET", false, nil)
+	if res.Code != http.StatusOK {
+		t.Error("/healthz without auth should return 200 and it returned", res.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	url := "/readyz"
+	res, m := doRequest(nil, url, "GET", false, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "without auth should return 200 and it returned", res.Code)
+	}
+	var status struct {
+		Status     string
+		Components []componentStatus
+	}
+	json.Unmarshal(res.Body.Bytes(), &status)
+	if status.Status != "ok" || len(status.Components) != 2 || status.Components[1].Name != "host:default" || status.Components[1].Status != "ok" {
+		t.Error(url, "without auth should return the status of every component and it returned", res.Body.String())
+	}
+	if status.Components[0].TLS != nil {
+		t.Error(url, "without auth should leave the TLS out and it returned", status.Components[0].TLS)
+	}
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	json.Unmarshal(res.Body.Bytes(), &status)
+	if len(status.Components) != 2 || status.Components[0].Name != "metadata" || status.Components[1].Name != "host:default" {
+		t.Error(url, "should report the metadata DB and every host and it returned", status.Components)
+	}
+	if tls := status.Components[0].TLS; tls == nil || tls.Sslmode != "" || tls.Verify != "none" || tls.Active != nil {
+		t.Error(url, "should report the configured TLS and leave what sqlite can't tell out and it returned", tls)
+	}
+
+	// One host that went away out of two
+	doRequest(m, "/admin/hosts", "POST", true, bytes.NewBufferString(`{"name":"shared2","url":"10.0.0.2"}`))
+	Hosts.Get(DefaultHostName).DB.Close()
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	json.Unmarshal(res.Body.Bytes(), &status)
+	if res.Code != http.StatusOK || status.Status != "degraded" {
+		t.Error(url, "with a host down out of two should return 200 and degraded and it returned", res.Code, status.Status)
+	}
+	if len(status.Components) != 3 || status.Components[1].Status != "unavailable" || status.Components[1].Error == "" {
+		t.Error(url, "should report the host error and it returned", status.Components)
+	}
+
+	// Every host
+	Hosts.Get("shared2").DB.Close()
+
+	res, _ = doRequest(m, url, "GET", false, nil)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Error(url, "with every host down should return 503 and it returned", res.Code)
+	}
+	status.Components = nil
+	json.Unmarshal(res.Body.Bytes(), &status)
+	if len(status.Components) != 3 || status.Components[1].Status != "unavailable" || status.Components[1].Error != "" {
+		t.Error(url, "without auth should report the host down without its error and it returned", status.Components)
+	}
+}
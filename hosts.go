@@ -0,0 +1,424 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The host that instances created before there was more than one belong to
+const DefaultHostName = "default"
+
+// BackingHost is a shared database server where instances are created.
+// Every host has its own connection pool. The registry never changes a
+// BackingHost it handed out, it swaps in a new one.
+type BackingHost struct {
+	Name     string
+	Rds      *RDS
+	Plans    []string
+	Draining bool
+	DB       *gorm.DB
+}
+
+// Pinned tells if the host is reserved for the plan
+func (h *BackingHost) Pinned(planId string) bool {
+	for _, id := range h.Plans {
+		if id == planId {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the bytes used by every database of the host
+func (h *BackingHost) Size() (int64, error) {
+	var size int64
+	err := h.DB.Raw("SELECT coalesce(sum(pg_database_size(datname)), 0) FROM pg_database").Row().Scan(&size)
+	return size, err
+}
+
+// PlacementStrategy picks the host for a new instance among candidates
+type PlacementStrategy func(candidates []*BackingHost, instance *Instance, db *gorm.DB) (*BackingHost, error)
+
+var placementStrategies = map[string]PlacementStrategy{
+	"least-databases": PlaceLeastDatabases,
+	"least-bytes":     PlaceLeastBytes,
+	"plan":            PlacePinnedByPlan,
+}
+
+func ValidPlacementStrategy(name string) bool {
+	_, ok := placementStrategies[name]
+	return ok
+}
+
+// PlaceLeastDatabases picks the host with the fewest instances
+func PlaceLeastDatabases(candidates []*BackingHost, instance *Instance, db *gorm.DB) (*BackingHost, error) {
+	var best *BackingHost
+	var bestCount int64
+
+	for _, host := range candidates {
+		count := HostInstanceCount(db, host.Name)
+		if best == nil || count < bestCount {
+			best, bestCount = host, count
+		}
+	}
+
+	return best, nil
+}
+
+// PlaceLeastBytes picks the host with the least data. Hosts that can't
+// report their size are skipped.
+func PlaceLeastBytes(candidates []*BackingHost, instance *Instance, db *gorm.DB) (*BackingHost, error) {
+	var best *BackingHost
+	var bestSize int64
+
+	for _, host := range candidates {
+		size, err := host.Size()
+		if err != nil {
+			Log.Error("Error getting the size of the host", err, "host", host.Name)
+			continue
+		}
+		if best == nil || size < bestSize {
+			best, bestSize = host, size
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("No host could report its size")
+	}
+	return best, nil
+}
+
+// PlacePinnedByPlan uses the hosts pinned to the plan of the instance and
+// the hosts without pins for every other plan, the least used first
+func PlacePinnedByPlan(candidates []*BackingHost, instance *Instance, db *gorm.DB) (*BackingHost, error) {
+	var pinned, unpinned []*BackingHost
+	for _, host := range candidates {
+		if host.Pinned(instance.PlanId) {
+			pinned = append(pinned, host)
+		} else if len(host.Plans) == 0 {
+			unpinned = append(unpinned, host)
+		}
+	}
+
+	if len(pinned) > 0 {
+		return PlaceLeastDatabases(pinned, instance, db)
+	}
+	if len(unpinned) > 0 {
+		return PlaceLeastDatabases(unpinned, instance, db)
+	}
+
+	return nil, fmt.Errorf("There is no host for the plan %s", instance.PlanId)
+}
+
+// HostInstanceCount counts the instances placed on a host
+func HostInstanceCount(db *gorm.DB, name string) int64 {
+	var count int64
+	query := db.Model(Instance{}).Where("host = ?", name)
+	if name == DefaultHostName {
+		query = db.Model(Instance{}).Where("host = ? OR host = ? OR host IS NULL", name, "")
+	}
+	query.Count(&count)
+	return count
+}
+
+var Hosts *HostRegistry
+
+// How often the registry picks up the hosts other brokers changed
+var HostRefreshInterval = time.Minute
+
+// How long the pool of a host that was replaced or removed stays open for
+// the provisions and binds still using it
+var RetiredHostCloseDelay = 15 * time.Minute
+
+// HostRegistry keeps the backing hosts and places new instances on them
+type HostRegistry struct {
+	mu       sync.RWMutex
+	hosts    map[string]*BackingHost
+	strategy PlacementStrategy
+	env      string
+}
+
+func NewHostRegistry(strategy, env string) (*HostRegistry, error) {
+	if strategy == "" {
+		strategy = "least-databases"
+	}
+	if !ValidPlacementStrategy(strategy) {
+		return nil, fmt.Errorf("Unknown placement strategy %s", strategy)
+	}
+
+	return &HostRegistry{
+		hosts:    map[string]*BackingHost{},
+		strategy: placementStrategies[strategy],
+		env:      env,
+	}, nil
+}
+
+// SyncHosts stores the hosts configured in settings, so they can be managed
+// like the hosts registered through the admin API. Hosts that already exist
+// get the configured connection settings and keep their draining state.
+func SyncHosts(db *gorm.DB, hosts []HostSettings, key string) error {
+	for _, hs := range hosts {
+		host := Host{}
+		db.Where("name = ?", hs.Name).First(&host)
+
+		host.Name = hs.Name
+		host.Url = hs.Rds.Url
+		host.Port = hs.Rds.Port
+		host.DbName = hs.Rds.DbName
+		host.Username = hs.Rds.Username
+		host.Sslmode = hs.Rds.Sslmode
+		host.SslRootCert = hs.Rds.SslRootCert
+		host.SslCert = hs.Rds.SslCert
+		host.SslKey = hs.Rds.SslKey
+		host.SslServerName = hs.Rds.SslServerName
+		host.Plans = strings.Join(hs.Plans, ",")
+		if host.Salt == "" {
+			host.Salt = GenerateSalt(aes.BlockSize)
+		}
+		if err := host.SetPassword(hs.Rds.Password, key); err != nil {
+			return err
+		}
+
+		if err := db.Save(&host).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load connects to every host stored in the DB and forgets the hosts that
+// are not there anymore. The hosts whose connection settings didn't change
+// keep their pool. Hosts that are down are added anyway: their pools
+// reconnect once they are back, and in the meantime /readyz reports them.
+func (hr *HostRegistry) Load(db *gorm.DB, key string) error {
+	var hosts []Host
+	if err := db.Find(&hosts).Error; err != nil {
+		return err
+	}
+
+	stored := map[string]bool{}
+	for i := range hosts {
+		host := &hosts[i]
+		stored[host.Name] = true
+
+		rds, err := host.Rds(key)
+		if err != nil {
+			return err
+		}
+		if current := hr.Get(host.Name); current != nil && *current.Rds == *rds {
+			updated := *current
+			updated.Plans = host.PlanIds()
+			updated.Draining = host.Draining
+			hr.Add(&updated)
+			continue
+		}
+
+		backing, err := hr.connect(host, key, false)
+		if err != nil {
+			return err
+		}
+		hr.Add(backing)
+	}
+
+	for _, host := range hr.All() {
+		if !stored[host.Name] {
+			hr.Remove(host.Name)
+		}
+	}
+
+	return nil
+}
+
+// RefreshHosts loads the hosts again every HostRefreshInterval until stop
+// is closed, so the changes made through other brokers get here
+func RefreshHosts(db *gorm.DB, hosts *HostRegistry, key string) func(stop <-chan struct{}) {
+	return func(stop <-chan struct{}) {
+		ticker := time.NewTicker(HostRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+
+			if err := hosts.Load(db, key); err != nil {
+				Log.Error("Error refreshing the hosts", err)
+			}
+		}
+	}
+}
+
+// Dial connects to host, without adding it to the registry yet. It fails
+// if the host can't be reached.
+func (hr *HostRegistry) Dial(host *Host, key string) (*BackingHost, error) {
+	return hr.connect(host, key, true)
+}
+
+func (hr *HostRegistry) connect(host *Host, key string, required bool) (*BackingHost, error) {
+	rds, err := host.Rds(key)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenDB(rds, hr.env)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to host %s: %s", host.Name, err)
+	}
+
+	if err := db.DB().Ping(); err != nil {
+		if required {
+			db.Close()
+			return nil, fmt.Errorf("Error connecting to host %s: %s", host.Name, err)
+		}
+		Log.Error("Host unreachable", err, "host", host.Name)
+	}
+
+	return &BackingHost{
+		Name:     host.Name,
+		Rds:      rds,
+		Plans:    host.PlanIds(),
+		Draining: host.Draining,
+		DB:       &db,
+	}, nil
+}
+
+// Add registers host, in place of the host with the same name
+func (hr *HostRegistry) Add(host *BackingHost) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if old, ok := hr.hosts[host.Name]; ok && old.DB != host.DB {
+		retire(old.DB)
+	}
+	hr.hosts[host.Name] = host
+}
+
+// Remove forgets a host and closes its connections
+func (hr *HostRegistry) Remove(name string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if host, ok := hr.hosts[name]; ok {
+		retire(host.DB)
+		delete(hr.hosts, name)
+	}
+}
+
+// retire closes the pool of a host once RetiredHostCloseDelay is over
+func retire(db *gorm.DB) {
+	time.AfterFunc(RetiredHostCloseDelay, func() { db.Close() })
+}
+
+// SetDraining stops or resumes the placement of new instances on a host
+func (hr *HostRegistry) SetDraining(name string, draining bool) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if host, ok := hr.hosts[name]; ok {
+		updated := *host
+		updated.Draining = draining
+		hr.hosts[name] = &updated
+	}
+}
+
+func (hr *HostRegistry) Get(name string) *BackingHost {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	return hr.hosts[name]
+}
+
+// All returns the hosts sorted by name
+func (hr *HostRegistry) All() []*BackingHost {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	hosts := []*BackingHost{}
+	for _, host := range hr.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Sort(hostsByName(hosts))
+
+	return hosts
+}
+
+// OpenInstanceDB connects to the database of the instance on its host, as
+// the instance role
+func (hr *HostRegistry) OpenInstanceDB(instance *Instance, key string) (gorm.DB, error) {
+	host, err := hr.HostFor(instance)
+	if err != nil {
+		return gorm.DB{}, err
+	}
+
+	password, err := instance.GetPassword(key)
+	if err != nil {
+		return gorm.DB{}, err
+	}
+
+	rds := *host.Rds
+	rds.DbName = instance.Database
+	rds.Username = instance.LoginUsername()
+	rds.Password = password
+
+	return OpenDB(&rds, hr.env)
+}
+
+// OpenInstanceDBAsHost connects to the database of the instance on its
+// host, as the host role
+func (hr *HostRegistry) OpenInstanceDBAsHost(instance *Instance) (gorm.DB, error) {
+	host, err := hr.HostFor(instance)
+	if err != nil {
+		return gorm.DB{}, err
+	}
+
+	rds := *host.Rds
+	rds.DbName = instance.Database
+
+	return OpenDB(&rds, hr.env)
+}
+
+// HostFor returns the host where the instance lives
+func (hr *HostRegistry) HostFor(instance *Instance) (*BackingHost, error) {
+	name := instance.Host
+	if name == "" {
+		name = DefaultHostName
+	}
+
+	host := hr.Get(name)
+	if host == nil {
+		return nil, fmt.Errorf("The host %s of instance %s is unknown", name, instance.Uuid)
+	}
+	return host, nil
+}
+
+// Place picks the host for a new instance among the hosts that are not
+// draining
+func (hr *HostRegistry) Place(instance *Instance, db *gorm.DB) (*BackingHost, error) {
+	candidates := []*BackingHost{}
+	for _, host := range hr.All() {
+		if !host.Draining {
+			candidates = append(candidates, host)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("There are no hosts available")
+	}
+
+	return hr.strategy(candidates, instance, db)
+}
+
+type hostsByName []*BackingHost
+
+func (h hostsByName) Len() int           { return len(h) }
+func (h hostsByName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hostsByName) Less(i, j int) bool { return h[i].Name < h[j].Name }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPlacement(t *testing.T) {
+	setup()
+
+	small := &BackingHost{Name: "small", DB: &DB}
+	big := &BackingHost{Name: "big", DB: &DB}
+	pinned := &BackingHost{Name: "pinned", DB: &DB, Plans: []string{"big-plan"}}
+
+	DB.Save(&Instance{Uuid: "one", Host: "big"})
+	DB.Save(&Instance{Uuid: "two", Host: "big"})
+	DB.Save(&Instance{Uuid: "three", Host: "pinned"})
+
+	candidates := []*BackingHost{big, pinned, small}
+
+	host, _ := PlaceLeastDatabases(candidates, &Instance{}, &DB)
+	if host != small {
+		t.Error("The host with fewest databases should be picked and it was", host.Name)
+	}
+
+	host, _ = PlacePinnedByPlan(candidates, &Instance{PlanId: "big-plan"}, &DB)
+	if host != pinned {
+		t.Error("The host pinned to the plan should be picked and it was", host.Name)
+	}
+
+	host, _ = PlacePinnedByPlan([]*BackingHost{big, pinned}, &Instance{PlanId: "other-plan"}, &DB)
+	if host != big {
+		t.Error("Hosts pinned to other plans should not be picked and it was", host.Name)
+	}
+
+	if _, err := PlacePinnedByPlan([]*BackingHost{pinned}, &Instance{PlanId: "other-plan"}, &DB); err == nil {
+		t.Error("Placing without a suitable host should fail")
+	}
+}
+
+func TestCreateInstanceRecordsHost(t *testing.T) {
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	i := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	if i.Host != DefaultHostName {
+		t.Error("The instance should record its host and it has", i.Host)
+	}
+}
+
+func TestHostsAdmin(t *testing.T) {
+	url := "/admin/hosts"
+	body := bytes.NewBufferString(`{"name":"shared2","url":"10.0.0.2","username":"rds","password":"secret"}`)
+	res, m := doRequest(nil, url, "POST", true, body)
+	if res.Code != http.StatusCreated {
+		t.Error(url, "with auth should return 201 and it returned", res.Code)
+	}
+
+	host := Host{}
+	DB.Where("name = ?", "shared2").First(&host)
+	if host.Password == "" || host.Password == "secret" {
+		t.Error("The host password should be encrypted and it is", host.Password)
+	}
+	if Hosts.Get("shared2") == nil {
+		t.Error("The host should be added to the registry")
+	}
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	var list struct {
+		Hosts []hostResponse
+	}
+	json.Unmarshal(res.Body.Bytes(), &list)
+	if len(list.Hosts) != 2 {
+		t.Error(url, "should list the default host and the new one and it returned", list.Hosts)
+	}
+
+	// Draining hosts get no new instances
+	doRequest(m, "/admin/hosts/default/drain", "POST", true, nil)
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	i := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	if i.Host != "shared2" {
+		t.Error("The instance should not be placed on a draining host and it was placed on", i.Host)
+	}
+
+	res, _ = doRequest(m, "/admin/hosts/shared2", "DELETE", true, nil)
+	if res.Code != http.StatusConflict {
+		t.Error("Deleting a host with instances should return 409 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, "/admin/hosts/default", "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error("Deleting a host without instances should return 200 and it returned", res.Code)
+	}
+	if Hosts.Get("default") != nil {
+		t.Error("The deleted host should be removed from the registry")
+	}
+
+	// A host that can't be saved stays out of the registry
+	DB.Exec("DROP TABLE hosts")
+	res, _ = doRequest(m, url, "POST", true, bytes.NewBufferString(`{"name":"shared3","url":"10.0.0.3"}`))
+	if res.Code != http.StatusInternalServerError {
+		t.Error(url, "should return 500 when the host can't be saved and it returned", res.Code)
+	}
+	if Hosts.Get("shared3") != nil {
+		t.Error("A host that wasn't saved should not be added to the registry")
+	}
+}
+
+func TestLoadPicksUpHostChanges(t *testing.T) {
+	setup()
+	key := "12345678901234567890123456789012"
+
+	// Hosts registered and drained through another broker
+	host := Host{Name: "shared2", Url: "10.0.0.2", Salt: GenerateSalt(aes.BlockSize)}
+	host.SetPassword("secret", key)
+	DB.Save(&host)
+	if err := Hosts.Load(&DB, key); err != nil || Hosts.Get("shared2") == nil {
+		t.Fatal("A host added by another broker should be loaded", err)
+	}
+	pool := Hosts.Get("shared2").DB
+
+	DB.Model(&host).UpdateColumn("draining", true)
+	Hosts.Load(&DB, key)
+	if loaded := Hosts.Get("shared2"); !loaded.Draining || loaded.DB != pool {
+		t.Error("A host drained by another broker should be draining and keep its pool", loaded.Draining)
+	}
+
+	DB.Delete(&host)
+	Hosts.Load(&DB, key)
+	if Hosts.Get("shared2") != nil {
+		t.Error("A host deleted by another broker should be removed")
+	}
+	if Hosts.Get(DefaultHostName) == nil {
+		t.Error("The other hosts should stay")
+	}
+}
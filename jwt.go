@@ -0,0 +1,295 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/auth"
+
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTSettings describes the issuer of the bearer tokens accepted on the
+// admin API, off without a JWKSURL
+type JWTSettings struct {
+	JWKSURL  string
+	Issuer   string
+	Audience string
+
+	// The scopes that give the admin and read-only roles
+	AdminScopes    []string
+	ReadOnlyScopes []string
+
+	// How long the keys are kept before being fetched again
+	CacheTTL time.Duration
+}
+
+// The least time between two fetches of the keys, so tokens with unknown
+// key IDs can't make the broker hammer the issuer
+var JWKSMinRefresh = 30 * time.Second
+
+// How far the clocks of the issuer and the broker can drift apart
+const jwtLeeway = 30 * time.Second
+
+// JWTVerifier checks RS256 tokens against the keys of the issuer. The keys
+// are cached, and fetched again when they expire or a token is signed with
+// a key that isn't known yet, e.g. after the issuer rotated its keys.
+type JWTVerifier struct {
+	settings JWTSettings
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func NewJWTVerifier(js JWTSettings) *JWTVerifier {
+	if js.CacheTTL == 0 {
+		js.CacheTTL = time.Hour
+	}
+	return &JWTVerifier{
+		settings: js,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// jwtClaims holds the claims the broker looks at. UAA puts the scopes in a
+// list, other issuers in a space separated string.
+type jwtClaims struct {
+	Issuer    string    `json:"iss"`
+	Subject   string    `json:"sub"`
+	Audience  jwtString `json:"aud"`
+	ExpiresAt float64   `json:"exp"`
+	NotBefore float64   `json:"nbf"`
+	Scope     jwtString `json:"scope"`
+	UserName  string    `json:"user_name"`
+	ClientId  string    `json:"client_id"`
+}
+
+// jwtString is a claim that can be a list or a single string
+type jwtString []string
+
+func (js *jwtString) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*js = list
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*js = strings.Fields(value)
+	return nil
+}
+
+func (js jwtString) Contains(value string) bool {
+	for _, v := range js {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Name is who the token is for
+func (c *jwtClaims) Name() string {
+	if c.UserName != "" {
+		return c.UserName
+	}
+	if c.ClientId != "" {
+		return c.ClientId
+	}
+	return c.Subject
+}
+
+// Role returns the role the scopes of the token give
+func (v *JWTVerifier) Role(claims *jwtClaims) string {
+	for _, scope := range v.settings.AdminScopes {
+		if claims.Scope.Contains(scope) {
+			return RoleAdmin
+		}
+	}
+	for _, scope := range v.settings.ReadOnlyScopes {
+		if claims.Scope.Contains(scope) {
+			return RoleReadOnly
+		}
+	}
+	return ""
+}
+
+// Verify checks the signature, issuer, audience and validity of token and
+// returns its claims
+func (v *JWTVerifier) Verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("The token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Invalid token header: %s", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("The token algorithm %q is not RS256", header.Alg)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("The token signature is invalid")
+	}
+
+	claims := &jwtClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("Invalid token claims: %s", err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.Add(-jwtLeeway).After(time.Unix(int64(claims.ExpiresAt), 0)) {
+		return nil, errors.New("The token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(int64(claims.NotBefore), 0)) {
+		return nil, errors.New("The token is not valid yet")
+	}
+	if claims.Issuer != v.settings.Issuer {
+		return nil, fmt.Errorf("The token issuer %q is not trusted", claims.Issuer)
+	}
+	if v.settings.Audience != "" && !claims.Audience.Contains(v.settings.Audience) {
+		return nil, fmt.Errorf("The token is not for the audience %s", v.settings.Audience)
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// key returns the key with the ID kid, fetching the keys when they expired
+// or kid is unknown. The fetch happens without the lock, so the other
+// requests keep using the cached keys in the meantime.
+func (v *JWTVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	age := time.Since(v.fetched)
+	key, known := v.keys[kid]
+	if (known && age < v.settings.CacheTTL) || (!known && age < JWKSMinRefresh) {
+		v.mu.Unlock()
+		if !known {
+			return nil, fmt.Errorf("The token key %q is unknown", kid)
+		}
+		return key, nil
+	}
+	// Failures count too, so a down issuer isn't asked on every request,
+	// and the requests that come during the fetch don't start another one
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	keys, err := v.fetch()
+	if err != nil {
+		// The issuer may be down for a while, the keys it had still work
+		if known {
+			Log.Error("Error fetching the JWKS, using the cached keys", err, "url", v.settings.JWKSURL)
+			return key, nil
+		}
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("The token key %q is unknown", kid)
+}
+
+// fetch gets the RSA keys of the issuer
+func (v *JWTVerifier) fetch() (map[string]*rsa.PublicKey, error) {
+	res, err := v.client.Get(v.settings.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching the JWKS: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching the JWKS: %s", res.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("Error reading the JWKS: %s", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			Log.Error("Skipping an invalid JWKS key", errors.New("invalid modulus or exponent"), "kid", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	Log.Info("Fetched the JWKS", "url", v.settings.JWKSURL, "keys", len(keys))
+	return keys, nil
+}
+
+// checkBearer authenticates a request with a bearer token against perm.
+// Tokens that are invalid get a 401 and tokens without the scope a 403.
+func (v *JWTVerifier) checkBearer(token string, perm Permission, res http.ResponseWriter, c martini.Context) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		Log.Error("Bearer token rejected", err)
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(res, "Not Authorized", http.StatusUnauthorized)
+		return
+	}
+
+	credential := Credential{Username: claims.Name(), Role: v.Role(claims)}
+	if !credential.Allows(perm) {
+		res.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		http.Error(res, "Forbidden", http.StatusForbidden)
+		return
+	}
+	c.Map(auth.User(credential.Username))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer stands in for UAA: it serves its keys as a JWKS and signs
+// tokens
+type testIssuer struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+	server  *httptest.Server
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	ti := &testIssuer{keys: map[string]*rsa.PrivateKey{}}
+	ti.addKey(t, "key-1")
+	ti.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		ti.fetches++
+
+		keys := []map[string]string{}
+		for kid, key := range ti.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	return ti
+}
+
+func (ti *testIssuer) addKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.mu.Lock()
+	ti.keys[kid] = key
+	ti.mu.Unlock()
+}
+
+func (ti *testIssuer) fetchCount() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.fetches
+}
+
+// token returns a token signed with the key kid, with the claims of a UAA
+// token for the broker plus the ones in extra
+func (ti *testIssuer) token(t *testing.T, kid string, extra map[string]interface{}) string {
+	claims := map[string]interface{}{
+		"iss":       "https://uaa.example.com/oauth/token",
+		"aud":       []string{"rds-broker"},
+		"sub":       "user-guid",
+		"user_name": "operator",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"scope":     []string{"openid", "rds-broker.admin"},
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	ti.mu.Lock()
+	key := ti.keys[kid]
+	ti.mu.Unlock()
+	if key == nil {
+		// Signed by a key the issuer doesn't publish
+		key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (ti *testIssuer) settings() JWTSettings {
+	return JWTSettings{
+		JWKSURL:        ti.server.URL,
+		Issuer:         "https://uaa.example.com/oauth/token",
+		Audience:       "rds-broker",
+		AdminScopes:    []string{"rds-broker.admin"},
+		ReadOnlyScopes: []string{"rds-broker.read"},
+		CacheTTL:       time.Hour,
+	}
+}
+
+func TestJWTAdminAuth(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+
+	s := testSettings()
+	s.Auth.JWT = issuer.settings()
+	m, err := App(s, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, url, token string) int {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(`{"limit": 5}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		m.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	admin := issuer.token(t, "key-1", nil)
+	reader := issuer.token(t, "key-1", map[string]interface{}{"scope": "openid rds-broker.read"})
+	none := issuer.token(t, "key-1", map[string]interface{}{"scope": []string{"openid"}})
+	unsigned := strings.Join(strings.Split(admin, ".")[:2], ".") + "."
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "key-1"})
+	algNone := base64.RawURLEncoding.EncodeToString(header) + "." + strings.Split(admin, ".")[1] + "."
+
+	checks := []struct {
+		name, method, url, token string
+		code                     int
+	}{
+		{"an admin token", "PUT", "/admin/quotas/org", admin, 200},
+		{"a read-only token", "GET", "/admin/quotas", reader, 200},
+		{"a read-only token", "PUT", "/admin/quotas/org", reader, 403},
+		{"a token without the scopes", "GET", "/admin/quotas", none, 403},
+		{"an expired token", "GET", "/admin/quotas", issuer.token(t, "key-1", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), 401},
+		{"a token from another issuer", "GET", "/admin/quotas", issuer.token(t, "key-1", map[string]interface{}{"iss": "https://evil.example.com"}), 401},
+		{"a token for another audience", "GET", "/admin/quotas", issuer.token(t, "key-1", map[string]interface{}{"aud": "cloud_controller"}), 401},
+		{"a token with a tampered signature", "GET", "/admin/quotas", admin[:len(admin)-10] + "AAAAAAAAAA", 401},
+		{"a token with an unknown key", "GET", "/admin/quotas", issuer.token(t, "key-9", nil), 401},
+		{"a token without a signature", "GET", "/admin/quotas", unsigned, 401},
+		{"a token with alg none", "GET", "/admin/quotas", algNone, 401},
+		{"an admin token on the broker API", "GET", "/v2/catalog", admin, 401},
+	}
+	for _, c := range checks {
+		if code := request(c.method, c.url, c.token); code != c.code {
+			t.Error(c.method, c.url, "with", c.name, "should return", c.code, "and it returned", code)
+		}
+	}
+
+	if fetches := issuer.fetchCount(); fetches != 1 {
+		t.Error("The keys should be cached, and not fetched again for unknown keys right away, and they were fetched", fetches, "times")
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.server.Close()
+
+	minRefresh := JWKSMinRefresh
+	JWKSMinRefresh = 0
+	defer func() { JWKSMinRefresh = minRefresh }()
+
+	v := NewJWTVerifier(issuer.settings())
+	if _, err := v.Verify(issuer.token(t, "key-1", nil)); err != nil {
+		t.Fatal("The token should be valid", err)
+	}
+	v.Verify(issuer.token(t, "key-1", nil))
+	if fetches := issuer.fetchCount(); fetches != 1 {
+		t.Error("Known keys should come from the cache and they were fetched", fetches, "times")
+	}
+
+	// The issuer starts signing with a new key
+	issuer.addKey(t, "key-2")
+	claims, err := v.Verify(issuer.token(t, "key-2", nil))
+	if err != nil {
+		t.Fatal("A token signed with a new key should be valid", err)
+	}
+	if claims.Name() != "operator" || v.Role(claims) != RoleAdmin {
+		t.Error("The token should be for an admin named operator and it is", claims.Name(), v.Role(claims))
+	}
+	if fetches := issuer.fetchCount(); fetches != 2 {
+		t.Error("An unknown key should fetch the keys again and they were fetched", fetches, "times")
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"github.com/go-martini/martini"
-	"github.com/martini-contrib/auth"
 	"github.com/martini-contrib/render"
 
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type RDS struct {
@@ -16,92 +19,307 @@ type RDS struct {
 	DbName   string
 	Sslmode  string
 	Port     string
+
+	// Files with the CA bundle, and the client certificate and key
+	SslRootCert string
+	SslCert     string
+	SslKey      string
+	// The name in the server certificate, when it isn't Url
+	SslServerName string
+}
+
+// HostSettings describes a shared server where instances are created
+type HostSettings struct {
+	Name  string
+	Rds   *RDS
+	Plans []string
 }
 
 type Settings struct {
 	EncryptionKey string
-	Rds           *RDS
+	// The default host, nil when there are only named hosts
+	Rds *RDS
+	// Where the broker keeps its state, Rds when nil
+	Metadata *RDS
+	// The dialect of the metadata DB, set once it is connected
+	Dialect string
+
+	// Where users manage their instances, {instance_id} being replaced by
+	// the instance ID
+	DashboardUrl string
+
+	// How long to keep trying to connect to the DB on startup
+	DBConnectTimeout time.Duration
+	// How long to wait for the requests and jobs in flight on shutdown
+	ShutdownTimeout time.Duration
+
+	// The PEM of the CA that signed the certificates of the hosts, handed
+	// to apps in their credentials
+	CACertificate string
+
+	Hosts             []HostSettings
+	PlacementStrategy string
+
+	StorageCheckInterval time.Duration
+	StorageWarnPercent   int64
+
+	// How often passwords are rotated, never when zero, and how long the
+	// previous ones keep working
+	RotationInterval time.Duration
+	RotationOverlap  time.Duration
+
+	// The address to listen on, host:port
+	Listen    string
+	ServerTLS ServerTLSSettings
+	Auth      AuthSettings
+	Limits    LimitSettings
+	// The services and plans to offer, the built-in ones when empty
+	Catalog []Service
+}
+
+// AuthSettings holds the credentials of the broker API, of the admin API
+// and of /metrics, which is off when no credential can use it
+type AuthSettings struct {
+	Credentials []Credential
+	// Reloaded when it changes
+	CredentialsFile string
+	// The issuer of the bearer tokens of the admin API
+	JWT JWTSettings
+
+	// The plaintext pairs from before roles: the first one can use the
+	// broker and admin APIs, the second one /metrics
+	Username        string
+	Password        string
+	MetricsUsername string
+	MetricsPassword string
 }
 
-func LoadRDS() *RDS {
-	rds := RDS{}
-	rds.Url = os.Getenv("DB_URL")
-	rds.Username = os.Getenv("DB_USER")
-	rds.Password = os.Getenv("DB_PASS")
-	rds.DbName = os.Getenv("DB_NAME")
-	rds.Sslmode = "verify-ca"
+// DashboardFor returns the dashboard URL of an instance, if there is one
+func (s *Settings) DashboardFor(instance *Instance) string {
+	if s.DashboardUrl == "" {
+		return ""
+	}
+	return strings.Replace(s.DashboardUrl, "{instance_id}", instance.Uuid, -1)
+}
 
-	if os.Getenv("DB_PORT") != "" {
-		rds.Port = os.Getenv("DB_PORT")
-	} else {
-		rds.Port = "5432"
+// MetadataRds returns the DB of the broker state
+func (s *Settings) MetadataRds() *RDS {
+	if s.Metadata != nil {
+		return s.Metadata
 	}
+	return s.Rds
+}
 
-	return &rds
+// HostDefaults returns where hosts without TLS settings get theirs: the
+// default host, or the metadata DB without one
+func (s *Settings) HostDefaults() *RDS {
+	if s.Rds != nil {
+		return s.Rds
+	}
+	return s.Metadata
 }
 
 func main() {
-	var settings Settings
-	log.Println("Loading settings")
-	settings.Rds = LoadRDS()
+	// The admin commands keep stdout for their output
+	if len(os.Args) > 1 {
+		Log = NewLogger(os.Stderr)
+	}
 
-	settings.EncryptionKey = os.Getenv("ENC_KEY")
-	if settings.EncryptionKey == "" {
-		log.Println("An encryption key is required")
-		return
+	Log.Info("Loading settings")
+	settings, err := LoadSettings()
+	if err != nil {
+		Log.Error("Invalid settings", err)
+		os.Exit(1)
+	}
+
+	if settings.Metadata == nil {
+		Log.Info("The broker state is kept in the database of the default host, set metadata to keep it apart")
+	}
+
+	if len(os.Args) > 1 {
+		os.Exit(RunCommand(os.Args[1:], settings, os.Stdout))
+	}
+
+	Log.Info("Loading app...")
+	m, err := App(settings, "prod")
+	if err != nil {
+		Log.Error("The app could not be loaded", err)
+		os.Exit(1)
 	}
 
-	log.Println("Loading app...")
-	m := App(&settings, "prod")
+	if err := HoldBrokerLock(&DB, settings.Dialect); err != nil {
+		Log.Error("The broker lock could not be taken", err)
+		os.Exit(1)
+	}
+
+	Log.Info("Resuming abandoned operations...")
+	ResumeOperations(&DB, Hosts)
+
+	BackgroundJobs.Go(SweepStaleBindings(&DB))
+	BackgroundJobs.Go(RefreshHosts(&DB, Hosts, settings.EncryptionKey))
+
+	Log.Info("Starting storage monitor...")
+	BackgroundJobs.Go(NewStorageMonitor(&DB, Hosts, settings).Run)
+
+	Log.Info("Starting credential rotation...")
+	BackgroundJobs.Go(NewCredentialRotator(&DB, Hosts, settings).Run)
+
+	server := &http.Server{Addr: settings.Listen, Handler: m}
+	server.TLSConfig, err = NewServerTLSConfig(settings.ServerTLS)
+	if err != nil {
+		Log.Error("The TLS config could not be loaded", err)
+		os.Exit(1)
+	}
 
-	log.Println("Starting app...")
-	m.Run()
+	Log.Info("Starting app...", "addr", server.Addr, "tls", server.TLSConfig != nil, "client_auth", settings.ServerTLS.ClientAuth)
+	if err := Serve(server, BackgroundJobs, &DB, settings.ShutdownTimeout); err != nil {
+		Log.Error("The server stopped", err)
+		os.Exit(1)
+	}
 }
 
-func App(settings *Settings, env string) *martini.ClassicMartini {
+// Init connects to the metadata DB, migrates it and connects to the hosts
+func Init(settings *Settings, env string) error {
+	if len(settings.Catalog) > 0 {
+		Catalog = settings.Catalog
+	}
 
-	err := DBInit(settings.Rds, env)
+	err := DBInit(settings.MetadataRds(), env, settings.DBConnectTimeout)
 	if err != nil {
-		log.Println("There was an error with the DB")
-		return nil
+		return err
 	}
+	settings.Dialect = dialectName(&DB)
 
-	m := martini.Classic()
+	Log.Info("Migrating")
+	applied, err := NewMigrator(&DB, settings).Up(0)
+	if err != nil {
+		return fmt.Errorf("Could not migrate the DB: %s", err)
+	}
+	Log.Info("Migrated", "applied", len(applied))
 
-	username := os.Getenv("AUTH_USER")
-	password := os.Getenv("AUTH_PASS")
+	Hosts, err = NewHostRegistry(settings.PlacementStrategy, env)
+	if err != nil {
+		return err
+	}
+
+	hosts := settings.Hosts
+	if len(hosts) == 0 && settings.Rds != nil {
+		hosts = []HostSettings{{Name: DefaultHostName, Rds: settings.Rds}}
+	}
+	if err := SyncHosts(&DB, hosts, settings.EncryptionKey); err != nil {
+		return fmt.Errorf("There was an error saving the hosts: %s", err)
+	}
+	if err := Hosts.Load(&DB, settings.EncryptionKey); err != nil {
+		return fmt.Errorf("There was an error loading the hosts: %s", err)
+	}
+
+	return nil
+}
+
+func App(settings *Settings, env string) (*martini.ClassicMartini, error) {
+	if err := Init(settings, env); err != nil {
+		return nil, err
+	}
+
+	m := newMartini()
+
+	authenticator, err := NewAuthenticator(settings.Auth)
+	if err != nil {
+		return nil, err
+	}
+	brokerAuth := BrokerAuth(settings, authenticator)
 
-	m.Use(auth.Basic(username, password))
 	m.Use(render.Renderer())
 
+	metrics := NewMetrics()
+	limits := NewLimits(settings.Limits, metrics)
+
+	BackgroundJobs = NewJobs()
+
 	m.Map(&DB)
+	m.Map(Hosts)
+	m.Map(BackgroundJobs)
 	m.Map(settings)
 
-	log.Println("Loading Routes")
+	Log.Info("Loading Routes")
+
+	m.Group("/v2", func(r martini.Router) {
+		// Serve the catalog with services and plans
+		r.Get("/catalog", metrics.Instrument("catalog", ""), func(r render.Render) {
+			catalog := map[string]interface{}{
+				"services": Catalog,
+			}
+			r.JSON(200, catalog)
+		})
+
+		// Fetch a service instance
+		r.Get("/service_instances/:id", metrics.Instrument("fetch_instance", ""), GetInstance)
+
+		// Create the service instance (cf create-service-instance)
+		r.Put("/service_instances/:id", limits.Provision(), metrics.Instrument("provision", "provision"), CreateInstance)
+
+		// Change the plan of a service instance (cf update-service)
+		r.Patch("/service_instances/:id", metrics.Instrument("update", ""), UpdateInstance)
+
+		// Bind the service to app (cf bind-service)
+		r.Put("/service_instances/:instance_id/service_bindings/:id", metrics.Instrument("bind", "bind"), BindInstance)
+
+		// Fetch a service binding
+		r.Get("/service_instances/:instance_id/service_bindings/:id", metrics.Instrument("fetch_binding", ""), GetBinding)
 
-	// Serve the catalog with services and plans
-	m.Get("/v2/catalog", func(r render.Render) {
-		services := BuildCatalog()
-		catalog := map[string]interface{}{
-			"services": services,
-		}
-		r.JSON(200, catalog)
-	})
+		// Poll an async bind or unbind
+		r.Get("/service_instances/:instance_id/service_bindings/:id/last_operation", metrics.Instrument("binding_last_operation", ""), BindingLastOperation)
 
-	// Create the service instance (cf create-service-instance)
-	m.Put("/v2/service_instances/:id", CreateInstance)
+		// Unbind the service from app
+		r.Delete("/service_instances/:instance_id/service_bindings/:id", metrics.Instrument("unbind", ""), UnbindInstance)
 
-	// Bind the service to app (cf bind-service)
-	m.Put("/v2/service_instances/:instance_id/service_bindings/:id", BindInstance)
+		// Delete service instance
+		r.Delete("/service_instances/:id", limits.Provision(), metrics.Instrument("deprovision", "deprovision"), DeleteInstance)
+	}, append(brokerAuth, limits.RateLimit(), LogParams, RequireDB)...)
 
-	// Unbind the service from app
-	m.Delete("/v2/service_instances/:instance_id/service_bindings/:id", func(p martini.Params, r render.Render) {
-		var emptyJson struct{}
-		r.JSON(200, emptyJson)
-	})
+	// Health checks for the platform, without credentials. Those that can
+	// read the admin API also get the components of /readyz.
+	m.Get("/healthz", Healthz)
+	m.Get("/readyz", authenticator.Identify(PermAdminRead), Readyz)
+
+	// Metrics for Prometheus, with their own credentials
+	if authenticator.Allows(PermMetrics) {
+		m.Get("/metrics", authenticator.Require(PermMetrics), metrics.Handler)
+	}
+
+	// Admin API
+	m.Group("/admin", func(r martini.Router) {
+		r.Get("/quotas", ListQuotas)
+		r.Get("/quotas/:scope/:guid", ShowQuota)
+		r.Put("/quotas/:scope", SetQuota)
+		r.Put("/quotas/:scope/:guid", SetQuota)
+		r.Delete("/quotas/:scope", DeleteQuota)
+		r.Delete("/quotas/:scope/:guid", DeleteQuota)
+
+		r.Get("/hosts", ListHosts)
+		r.Post("/hosts", CreateHost)
+		r.Put("/hosts/:name", UpdateHost)
+		r.Post("/hosts/:name/drain", DrainHost)
+		r.Delete("/hosts/:name", DeleteHost)
+
+		r.Get("/service_keys", ListServiceKeys)
+
+		r.Post("/instances/:id/rotate", RotateCredentials)
+	}, authenticator.RequireAdmin(), RequireDB)
+
+	return m, nil
+}
 
-	// Delete service instance
-	m.Delete("/v2/service_instances/:id", DeleteInstance)
+// newMartini sets up martini like martini.Classic, with JSON request logs
+// and without serving static files
+func newMartini() *martini.ClassicMartini {
+	r := martini.NewRouter()
+	m := martini.New()
+	m.Map(log.New(Log.Writer("info"), "", 0))
+	m.Use(RequestLogger)
+	m.Use(martini.Recovery())
+	m.MapTo(r, (*martini.Routes)(nil))
+	m.Action(r.Handle)
 
-	return m
+	return &martini.ClassicMartini{Martini: m, Router: r}
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -13,15 +15,49 @@ import (
 	"testing"
 )
 
-func setup() *martini.ClassicMartini {
+// The statements run on the hosts, and the one the tests make fail. SQLite
+// has no databases or roles, so the rest only get recorded.
+var (
+	hostStatements    []string
+	failHostStatement string
+)
+
+func init() {
+	hostExec = func(db *gorm.DB, l *Logger, statement string) error {
+		hostStatements = append(hostStatements, statement)
+		if failHostStatement != "" && strings.HasPrefix(statement, failHostStatement) {
+			return errors.New("Failing " + failHostStatement)
+		}
+		return nil
+	}
+}
+
+// testSettings returns the settings of the broker under test
+func testSettings() *Settings {
 	os.Setenv("AUTH_USER", "default")
 	os.Setenv("AUTH_PASS", "default")
 	var s Settings
 	var r RDS
 	s.Rds = &r
 	s.EncryptionKey = "12345678901234567890123456789012"
+	s.Dialect = "sqlite3"
+	// A plan without limits or extras next to the default one
+	s.Catalog = BuildCatalog()
+	s.Catalog[0].Plans = append(s.Catalog[0].Plans, Plan{Id: "the-plan", Name: "the-plan"})
+	s.Auth = AuthSettings{
+		Username:        os.Getenv("AUTH_USER"),
+		Password:        os.Getenv("AUTH_PASS"),
+		MetricsUsername: os.Getenv("METRICS_USER"),
+		MetricsPassword: os.Getenv("METRICS_PASS"),
+	}
+	return &s
+}
 
-	m := App(&s, "test")
+func setup() *martini.ClassicMartini {
+	m, err := App(testSettings(), "test")
+	if err != nil {
+		panic(err)
+	}
 
 	return m
 }
@@ -42,6 +78,16 @@ func doRequest(m *martini.ClassicMartini, url string, method string, auth bool,
 	return res, m
 }
 
+// newInstance is the body of a provision request for the test plan
+func newInstance() io.Reader {
+	return bytes.NewBufferString(`{"plan_id": "the-plan"}`)
+}
+
+// appBinding is the body of a bind request for an app
+func appBinding() io.Reader {
+	return bytes.NewBufferString(`{"bind_resource": {"app_guid": "the-app"}}`)
+}
+
 func validJson(response []byte, url string, t *testing.T) {
 	var aJson map[string]interface{}
 	if json.Unmarshal(response, &aJson) != nil {
@@ -106,6 +152,12 @@ func TestCreateInstance(t *testing.T) {
 	if i.PlanId != "the-plan" || i.OrgGuid != "an-org" || i.SpaceGuid != "a-space" {
 		t.Error("The instance should have metadata")
 	}
+
+	// A plan that is not in the catalog
+	res, _ = doRequest(nil, "/v2/service_instances/other_instance", "PUT", true, bytes.NewBufferString(`{"plan_id":"other-plan"}`))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an unknown plan should return 400 and it returned", res.Code)
+	}
 }
 
 func TestBindInstance(t *testing.T) {
@@ -118,7 +170,7 @@ func TestBindInstance(t *testing.T) {
 	}
 
 	// Create the instance and try again
-	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, nil)
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, newInstance())
 
 	res, _ = doRequest(m, url, "PUT", true, nil)
 	if res.Code != http.StatusCreated {
@@ -158,6 +210,44 @@ func TestBindInstance(t *testing.T) {
 	}
 }
 
+func TestBindServiceKey(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_key"
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	hostStatements = nil
+
+	// Without an app the binding is a service key with a role of its own
+	res, _ := doRequest(m, url, "PUT", true, nil)
+	if res.Code != http.StatusCreated {
+		t.Fatal(url, "should return 201 and it returned", res.Code)
+	}
+
+	var response struct {
+		Credentials map[string]string `json:"credentials"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &response)
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	binding := Binding{}
+	DB.Where("uuid = ?", "the_key").First(&binding)
+	if binding.Kind != BindingServiceKey || binding.State != StateSucceeded {
+		t.Error("The binding should be a succeeded service key and it is", binding.Kind, binding.State)
+	}
+	if username := response.Credentials["username"]; username != binding.Username || username == instance.Username || !strings.HasPrefix(username, "k") {
+		t.Error(url, "should return the role of the key and it returned", username)
+	}
+
+	created := false
+	for _, statement := range hostStatements {
+		if strings.HasPrefix(statement, "CREATE USER "+binding.Username+" ") && strings.HasSuffix(statement, "IN ROLE "+instance.Username) {
+			created = true
+		}
+	}
+	if !created {
+		t.Error("The role of the key should be created in the instance role and the statements are", hostStatements)
+	}
+}
+
 func TestUnbind(t *testing.T) {
 	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
 	res, _ := doRequest(nil, url, "DELETE", true, nil)
@@ -185,7 +275,7 @@ func TestDeleteInstance(t *testing.T) {
 	}
 
 	// Create the instance and try again
-	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, nil)
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, newInstance())
 	i := Instance{}
 	DB.Where("uuid = ?", "the_instance").First(&i)
 	if i.Id == 0 {
@@ -205,3 +295,259 @@ func TestDeleteInstance(t *testing.T) {
 		t.Error("The instance shouldn't be in the DB")
 	}
 }
+
+func TestCreateInstanceFailure(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	failHostStatement = "GRANT"
+	defer func() { failHostStatement = "" }()
+
+	hostStatements = nil
+	res, _ := doRequest(nil, url, "PUT", true, newInstance())
+	if res.Code != http.StatusInternalServerError {
+		t.Error(url, "should return 500 when the database can't be made and it returned", res.Code)
+	}
+
+	i := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	if i.Id > 0 {
+		t.Error("The instance shouldn't be saved when its database can't be made")
+	}
+	if all := strings.Join(hostStatements, ";"); !strings.Contains(all, "DROP DATABASE IF EXISTS") || !strings.Contains(all, "DROP USER IF EXISTS") {
+		t.Error("What the provision made should be dropped and it ran", hostStatements)
+	}
+	var count int
+	DB.Model(PendingOperation{}).Count(&count)
+	if count != 0 {
+		t.Error("The cleaned up provision shouldn't be left pending")
+	}
+}
+
+func TestDeleteInstanceFailure(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	_, m := doRequest(nil, url, "PUT", true, newInstance())
+	doRequest(m, url+"/service_bindings/the_binding", "PUT", true, appBinding())
+
+	failHostStatement = "DROP USER"
+	defer func() { failHostStatement = "" }()
+	res, _ := doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusInternalServerError {
+		t.Error(url, "should return 500 when a role can't be dropped and it returned", res.Code)
+	}
+
+	i := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	binding := Binding{}
+	DB.Where("uuid = ?", "the_binding").First(&binding)
+	if i.Id == 0 || binding.Id == 0 {
+		t.Error("The instance and its bindings should be kept for a retry")
+	}
+
+	failHostStatement = ""
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "should succeed when retried and it returned", res.Code)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	url := "/admin/quotas/org"
+	res, m := doRequest(nil, url, "PUT", true, bytes.NewBufferString(`{"limit": 1}`))
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	// An override for another org
+	doRequest(m, "/admin/quotas/org/big-org", "PUT", true, bytes.NewBufferString(`{"limit": -1}`))
+
+	provision := func(id, org string) int {
+		body := bytes.NewBufferString(`{"plan_id":"the-plan","organization_guid":"` + org + `","space_guid":"a-space"}`)
+		res, _ := doRequest(m, "/v2/service_instances/"+id, "PUT", true, body)
+		return res.Code
+	}
+
+	if code := provision("first", "an-org"); code != http.StatusCreated {
+		t.Error("The first instance should fit in the quota and it returned", code)
+	}
+
+	if code := provision("second", "an-org"); code != http.StatusForbidden {
+		t.Error("The second instance should exceed the quota and it returned", code)
+	}
+
+	for _, id := range []string{"third", "fourth"} {
+		if code := provision(id, "big-org"); code != http.StatusCreated {
+			t.Error("An org without limit should be able to provision and it returned", code)
+		}
+	}
+
+	res, _ = doRequest(m, "/admin/quotas/org/an-org", "GET", true, nil)
+	var q quotaResponse
+	json.Unmarshal(res.Body.Bytes(), &q)
+	if q.Limit != 1 || q.Used != 1 {
+		t.Error("The quota should show the limit and usage and it returned", q)
+	}
+}
+
+func TestQuotasCountProvisionsInProgress(t *testing.T) {
+	_, m := doRequest(nil, "/admin/quotas/org", "PUT", true, bytes.NewBufferString(`{"limit": 1}`))
+
+	op, err := ReserveQuotas(&DB, "sqlite3", &Instance{Uuid: "pending", OrgGuid: "an-org", PlanId: "the-plan"})
+	if err != nil {
+		t.Fatal("The first provision should fit in the quota and it returned", err)
+	}
+	if _, err := ReserveQuotas(&DB, "sqlite3", &Instance{Uuid: "other", OrgGuid: "an-org", PlanId: "the-plan"}); err == nil {
+		t.Error("A provision in progress should count against the quota")
+	}
+	body := bytes.NewBufferString(`{"plan_id":"the-plan","organization_guid":"an-org"}`)
+	if res, _ := doRequest(m, "/v2/service_instances/other", "PUT", true, body); res.Code != http.StatusForbidden {
+		t.Error("A provision along one in progress should exceed the quota and it returned", res.Code)
+	}
+
+	op.Finish(&DB)
+	if _, err := ReserveQuotas(&DB, "sqlite3", &Instance{Uuid: "other", OrgGuid: "an-org", PlanId: "the-plan"}); err != nil {
+		t.Error("A provision that is over should not count against the quota and it returned", err)
+	}
+}
+
+func TestUpdateInstance(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	res, m := doRequest(nil, url, "PATCH", true, bytes.NewBufferString(`{"plan_id":"other-plan"}`))
+
+	// Without the instance
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	doRequest(m, url, "PUT", true, bytes.NewBufferString(`{"plan_id":"the-plan"}`))
+
+	res, _ = doRequest(m, url, "PATCH", true, bytes.NewBufferString(`{"plan_id":"other-plan"}`))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with a plan that is not in the catalog should return 400 and it returned", res.Code)
+	}
+
+	// The roles can't get the profile of the new plan
+	plan := BuildCatalog()[0].Plans[0]
+	failHostStatement = "ALTER ROLE"
+	res, _ = doRequest(m, url, "PATCH", true, bytes.NewBufferString(`{"plan_id":"`+plan.Id+`"}`))
+	failHostStatement = ""
+	if res.Code != http.StatusInternalServerError {
+		t.Error(url, "should fail when the profile can't be applied and it returned", res.Code)
+	}
+	i := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	if i.PlanId != "the-plan" {
+		t.Error("A failed update should keep the plan and it changed to", i.PlanId)
+	}
+
+	res, _ = doRequest(m, url, "PATCH", true, bytes.NewBufferString(`{"plan_id":"`+plan.Id+`"}`))
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	DB.Where("uuid = ?", "the_instance").First(&i)
+	if i.PlanId != plan.Id {
+		t.Error("The instance should have the new plan and it has", i.PlanId)
+	}
+}
+
+func TestGetInstance(t *testing.T) {
+	url := "/v2/service_instances/the_instance"
+	res, m := doRequest(nil, url, "GET", true, nil)
+
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	doRequest(m, url, "PUT", true, bytes.NewBufferString(`{
+		"service_id":"the-service",
+		"plan_id":"the-plan",
+		"parameters":{"extensions":["postgis"]}
+	}`))
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	var r struct {
+		ServiceId  string `json:"service_id"`
+		PlanId     string `json:"plan_id"`
+		Parameters map[string][]string
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+	if r.ServiceId != "the-service" || r.PlanId != "the-plan" || r.Parameters["extensions"][0] != "postgis" {
+		t.Error(url, "should return the plan and parameters and it returned", string(res.Body.Bytes()))
+	}
+}
+
+func TestGetBinding(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	res, m := doRequest(nil, url, "GET", true, nil)
+
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "with auth should return 404 and it returned", res.Code)
+	}
+
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	bind, _ := doRequest(m, url, "PUT", true, appBinding())
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+	if !strings.Contains(string(res.Body.Bytes()), `"credentials"`) {
+		t.Error(url, "should return the credentials and it returned", string(res.Body.Bytes()))
+	}
+
+	var bound, fetched map[string]interface{}
+	json.Unmarshal(bind.Body.Bytes(), &bound)
+	json.Unmarshal(res.Body.Bytes(), &fetched)
+	if bound["credentials"].(map[string]interface{})["uri"] != fetched["credentials"].(map[string]interface{})["uri"] {
+		t.Error(url, "should return the credentials of the binding")
+	}
+
+	// Binding again returns 200
+	res, _ = doRequest(m, url, "PUT", true, appBinding())
+	if res.Code != http.StatusOK {
+		t.Error(url, "for an existing binding should return 200 and it returned", res.Code)
+	}
+
+	doRequest(m, url, "DELETE", true, nil)
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "after unbinding should return 404 and it returned", res.Code)
+	}
+}
+
+func TestBindCredentials(t *testing.T) {
+	url := "/v2/service_instances/the_instance/service_bindings/the_binding"
+	plan := BuildCatalog()[0].Plans[0]
+
+	m := setup()
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, bytes.NewBufferString(`{"plan_id":"`+plan.Id+`"}`))
+	res, _ := doRequest(m, url, "PUT", true, appBinding())
+
+	var response struct {
+		Credentials map[string]string `json:"credentials"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	credentials := response.Credentials
+
+	if _, ok := credentials["port"]; !ok {
+		t.Error(url, "should return the port")
+	}
+	if credentials["sslmode"] != "verify-full" || !strings.HasSuffix(credentials["uri"], "?sslmode=verify-full") {
+		t.Error(url, "should require verify-full and it returned", credentials["sslmode"], credentials["uri"])
+	}
+	if !strings.HasPrefix(credentials["jdbcUrl"], "jdbc:postgresql://") || !strings.Contains(credentials["jdbcUrl"], "sslmode=verify-full") {
+		t.Error(url, "should return a JDBC URL and it returned", credentials["jdbcUrl"])
+	}
+
+	// Plans without the extras keep the plain credentials
+	doRequest(m, "/v2/service_instances/other_instance", "PUT", true, bytes.NewBufferString(`{"plan_id":"the-plan"}`))
+	res, _ = doRequest(m, "/v2/service_instances/other_instance/service_bindings/other_binding", "PUT", true, appBinding())
+	response.Credentials = nil
+	json.Unmarshal(res.Body.Bytes(), &response)
+	if _, ok := response.Credentials["jdbcUrl"]; ok {
+		t.Error("A plan without extras should not get a JDBC URL")
+	}
+}
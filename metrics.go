@@ -0,0 +1,320 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/jinzhu/gorm"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request duration histogram, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// Metrics collects the broker counters and renders them, along with the
+// tenant usage gauges, in the Prometheus text format
+type Metrics struct {
+	mu         sync.Mutex
+	requests   map[string]int64
+	durations  map[string]*histogram
+	operations map[string]int64
+	throttled  map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:   map[string]int64{},
+		durations:  map[string]*histogram{},
+		operations: map[string]int64{},
+		throttled:  map[string]int64{},
+	}
+}
+
+// The label values of a series are joined with this to key the maps
+const labelSeparator = "\x00"
+
+func (m *Metrics) ObserveRequest(route, method string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[strings.Join([]string{route, method, strconv.Itoa(code)}, labelSeparator)]++
+
+	h, ok := m.durations[route]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(durationBuckets))}
+		m.durations[route] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *Metrics) ObserveOperation(operation, plan string, success bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	m.operations[strings.Join([]string{operation, plan, result}, labelSeparator)]++
+}
+
+// Instrument returns a handler that counts and times the requests of an OSB
+// route. Provision, bind and deprovision requests also count as operations
+// of their plan.
+func (m *Metrics) Instrument(route, operation string) martini.Handler {
+	return func(c martini.Context, rw http.ResponseWriter, req *http.Request) {
+		plan := ""
+		if operation != "" {
+			plan = planFromRequest(req)
+		}
+
+		start := time.Now()
+		c.Next()
+
+		code := rw.(martini.ResponseWriter).Status()
+		m.ObserveRequest(route, req.Method, code, time.Since(start))
+		if operation != "" {
+			m.ObserveOperation(operation, plan, code < 400)
+		}
+	}
+}
+
+// The plan label of the operations whose plan is not in the catalog, so
+// clients can't make up series
+const unknownPlan = "unknown"
+
+// planFromRequest finds the plan id in the query string or the JSON body,
+// leaving the body in place for the handler
+func planFromRequest(req *http.Request) string {
+	plan := req.URL.Query().Get("plan_id")
+	if plan == "" && req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var sr serviceReq
+		json.Unmarshal(body, &sr)
+		plan = sr.PlainId
+	}
+
+	if FindPlan(plan) == nil {
+		return unknownPlan
+	}
+	return plan
+}
+
+// ObserveThrottled counts a request rejected by a limit
+func (m *Metrics) ObserveThrottled(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.throttled[reason]++
+}
+
+// Handler serves the metrics
+func (m *Metrics) Handler(rw http.ResponseWriter, db *gorm.DB, hosts *HostRegistry) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteCounters(rw)
+	writeUsage(rw, db, hosts)
+}
+
+func (m *Metrics) WriteCounters(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "rds_broker_http_requests_total", "counter", "Requests to the broker API by route, method and status code.")
+	for _, key := range sortedKeys(m.requests) {
+		values := strings.Split(key, labelSeparator)
+		writeSample(w, "rds_broker_http_requests_total", []string{"route", values[0], "method", values[1], "code", values[2]}, float64(m.requests[key]))
+	}
+
+	writeHeader(w, "rds_broker_http_request_duration_seconds", "histogram", "Latency of the broker API by route.")
+	routes := []string{}
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.durations[route]
+		for i, bound := range durationBuckets {
+			writeSample(w, "rds_broker_http_request_duration_seconds_bucket", []string{"route", route, "le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(h.counts[i]))
+		}
+		writeSample(w, "rds_broker_http_request_duration_seconds_bucket", []string{"route", route, "le", "+Inf"}, float64(h.count))
+		writeSample(w, "rds_broker_http_request_duration_seconds_sum", []string{"route", route}, h.sum)
+		writeSample(w, "rds_broker_http_request_duration_seconds_count", []string{"route", route}, float64(h.count))
+	}
+
+	writeHeader(w, "rds_broker_operations_total", "counter", "Provision, bind and deprovision operations by plan and result.")
+	for _, key := range sortedKeys(m.operations) {
+		values := strings.Split(key, labelSeparator)
+		writeSample(w, "rds_broker_operations_total", []string{"operation", values[0], "plan", values[1], "result", values[2]}, float64(m.operations[key]))
+	}
+
+	writeHeader(w, "rds_broker_throttled_requests_total", "counter", "Requests answered with 429 by the rate limit or the provisioning cap.")
+	for _, reason := range sortedKeys(m.throttled) {
+		writeSample(w, "rds_broker_throttled_requests_total", []string{"reason", reason}, float64(m.throttled[reason]))
+	}
+}
+
+// writeUsage reports the instances per plan and host, and the size and
+// connections of every instance database
+func writeUsage(w io.Writer, db *gorm.DB, hosts *HostRegistry) {
+	var instances []Instance
+	db.Find(&instances)
+
+	counts := map[string]int64{}
+	byDatabase := map[string]map[string]*Instance{}
+	for i := range instances {
+		instance := &instances[i]
+		host := instance.Host
+		if host == "" {
+			host = DefaultHostName
+		}
+
+		counts[instance.PlanId+labelSeparator+host]++
+		if byDatabase[host] == nil {
+			byDatabase[host] = map[string]*Instance{}
+		}
+		byDatabase[host][instance.Database] = instance
+	}
+
+	writeHeader(w, "rds_broker_instances", "gauge", "Instances by plan and host.")
+	for _, key := range sortedKeys(counts) {
+		values := strings.Split(key, labelSeparator)
+		writeSample(w, "rds_broker_instances", []string{"plan", values[0], "host", values[1]}, float64(counts[key]))
+	}
+
+	// The hosts are asked together, and those that don't answer in time
+	// are left out
+	all := hosts.All()
+	results := make(chan []usage, len(all))
+	for _, host := range all {
+		go func(host *BackingHost) {
+			results <- hostUsage(host, byDatabase[host.Name], MetricsHostTimeout)
+		}(host)
+	}
+	usages := []usage{}
+	for range all {
+		usages = append(usages, <-results...)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].host != usages[j].host {
+			return usages[i].host < usages[j].host
+		}
+		return usages[i].instance < usages[j].instance
+	})
+
+	writeHeader(w, "rds_broker_instance_database_bytes", "gauge", "Size of each instance database.")
+	for _, u := range usages {
+		writeSample(w, "rds_broker_instance_database_bytes", []string{"instance", u.instance, "host", u.host}, float64(u.bytes))
+	}
+
+	writeHeader(w, "rds_broker_instance_connections", "gauge", "Open connections to each instance database.")
+	for _, u := range usages {
+		writeSample(w, "rds_broker_instance_connections", []string{"instance", u.instance, "host", u.host}, float64(u.connections))
+	}
+}
+
+// How long /metrics waits for the database stats of each host
+var MetricsHostTimeout = 2 * time.Second
+
+type usage struct {
+	instance    string
+	host        string
+	bytes       int64
+	connections int64
+}
+
+// hostUsage reads the size and connections of the instance databases of
+// host, giving up after timeout
+func hostUsage(host *BackingHost, instances map[string]*Instance, timeout time.Duration) []usage {
+	done := make(chan []usage, 1)
+	go func() {
+		usages := []usage{}
+		defer func() { done <- usages }()
+
+		rows, err := host.DB.Raw("SELECT datname, numbackends, pg_database_size(datname) FROM pg_stat_database").Rows()
+		if err != nil {
+			Log.Error("Error reading the database stats of the host", err, "host", host.Name)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var u usage
+			var datname string
+			if err := rows.Scan(&datname, &u.connections, &u.bytes); err != nil {
+				continue
+			}
+			if instance, ok := instances[datname]; ok {
+				u.instance = instance.Uuid
+				u.host = host.Name
+				usages = append(usages, u)
+			}
+		}
+	}()
+
+	select {
+	case usages := <-done:
+		return usages
+	case <-time.After(timeout):
+		Log.Error("Error reading the database stats of the host", errors.New("timed out"), "host", host.Name)
+		return nil
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one series, labels being name and value pairs
+func writeSample(w io.Writer, name string, labels []string, value float64) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], escapeLabel(labels[i+1])))
+	}
+
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// escapeLabel drops the control characters other than newlines, which %q
+// would escape in a way the exposition format doesn't understand
+func escapeLabel(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func sortedKeys(values map[string]int64) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
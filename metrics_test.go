@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	os.Setenv("METRICS_USER", "metrics")
+	os.Setenv("METRICS_PASS", "metrics")
+	defer os.Unsetenv("METRICS_USER")
+
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, strings.NewReader(`{"plan_id":"the-plan"}`))
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, strings.NewReader(`{"plan_id":"the-plan"}`))
+	doRequest(m, "/v2/service_instances/other_instance", "PUT", true, strings.NewReader(`{"plan_id":"made-up"}`))
+
+	// The broker credentials are not enough
+	res, _ := doRequest(m, "/metrics", "GET", true, nil)
+	if res.Code != http.StatusUnauthorized {
+		t.Error("/metrics with the broker credentials should return 401 and it returned", res.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("metrics", "metrics")
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Error("/metrics with its credentials should return 200 and it returned", res.Code)
+	}
+
+	body := res.Body.String()
+	expected := []string{
+		`rds_broker_http_requests_total{route="provision",method="PUT",code="201"} 1`,
+		`rds_broker_http_requests_total{route="provision",method="PUT",code="409"} 1`,
+		`rds_broker_http_request_duration_seconds_count{route="provision"} 3`,
+		`rds_broker_operations_total{operation="provision",plan="the-plan",result="success"} 1`,
+		`rds_broker_operations_total{operation="provision",plan="the-plan",result="failure"} 1`,
+		`rds_broker_operations_total{operation="provision",plan="unknown",result="failure"} 1`,
+		`rds_broker_instances{plan="the-plan",host="default"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Error("/metrics should contain", line)
+		}
+	}
+	if strings.Contains(body, "made-up") {
+		t.Error("/metrics should not have a series for a plan that is not in the catalog")
+	}
+}
+
+func TestHostUsageTimeout(t *testing.T) {
+	setup()
+	host := Hosts.Get(DefaultHostName)
+
+	// The only connection of the host is taken, so the stats never come
+	conn, err := host.DB.DB().Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if usages := hostUsage(host, nil, 50*time.Millisecond); len(usages) != 0 {
+		t.Error("A host that doesn't answer should be left out and it returned", usages)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("A host that doesn't answer should not hold up the metrics")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Migration is a versioned change of the metadata DB. Up and Down are the
+// SQL statements that make and undo it, where {{id}} and {{timestamp}}
+// stand for the primary key and timestamp types of the DB. UpFunc and
+// DownFunc change the data where SQL can't, e.g. to re-encrypt passwords:
+// UpFunc runs after the statements of Up and DownFunc before the ones of
+// Down.
+//
+// A released migration must not change, the checksum of its statements is
+// stored when it is applied and checked on every start.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+
+	UpFunc   func(tx *gorm.DB, s *Settings) error
+	DownFunc func(tx *gorm.DB, s *Settings) error
+}
+
+// Migrations are the migrations of the metadata DB, oldest first. New ones
+// go at the end with the next version.
+var Migrations = []Migration{
+	{
+		// The schema AutoMigrate made last, before migrations. The DBs of
+		// older brokers get the columns they miss.
+		Version: 1,
+		Name:    "baseline",
+		Up:      createTables(baselineTables),
+		UpFunc: func(tx *gorm.DB, s *Settings) error {
+			return addMissingColumns(tx, s.Dialect, baselineTables)
+		},
+		// Rolling it back would drop the broker state
+	},
+	{
+		// Provisions count against the quotas until the instance is saved
+		Version: 2,
+		Name:    "pending_operation_quotas",
+		Up: []string{
+			"ALTER TABLE pending_operations ADD COLUMN org_guid varchar(255)",
+			"ALTER TABLE pending_operations ADD COLUMN space_guid varchar(255)",
+			"ALTER TABLE pending_operations ADD COLUMN plan_id varchar(255)",
+		},
+		Down: []string{
+			"ALTER TABLE pending_operations DROP COLUMN org_guid",
+			"ALTER TABLE pending_operations DROP COLUMN space_guid",
+			"ALTER TABLE pending_operations DROP COLUMN plan_id",
+		},
+	},
+}
+
+type tableSchema struct {
+	name    string
+	columns []string
+}
+
+var baselineTables = []tableSchema{
+	{"instances", []string{"id {{id}}", "uuid varchar(255)", "database varchar(255)", "username varchar(255)", "password varchar(255)", "salt varchar(255)",
+		"service_id varchar(255)", "plan_id varchar(255)", "org_guid varchar(255)", "space_guid varchar(255)", "parameters text", "host varchar(255)",
+		"storage_state varchar(255)", "storage_bytes bigint", "login_role varchar(255)", "retiring_role varchar(255)", "retire_at {{timestamp}}", "rotated_at {{timestamp}}",
+		"created_at {{timestamp}}", "updated_at {{timestamp}}", "deleted_at {{timestamp}}"}},
+	{"quotas", []string{"id {{id}}", "scope varchar(255)", "guid varchar(255)", `"limit" bigint`, "created_at {{timestamp}}", "updated_at {{timestamp}}"}},
+	{"storage_events", []string{"id {{id}}", "instance_uuid varchar(255)", "state varchar(255)", "bytes bigint", "limit_bytes bigint", "created_at {{timestamp}}"}},
+	{"hosts", []string{"id {{id}}", "name varchar(255)", "url varchar(255)", "port varchar(255)", "db_name varchar(255)", "username varchar(255)", "password varchar(255)",
+		"salt varchar(255)", "sslmode varchar(255)", "ssl_root_cert varchar(255)", "ssl_cert varchar(255)", "ssl_key varchar(255)", "ssl_server_name varchar(255)",
+		"plans text", "draining boolean", "created_at {{timestamp}}", "updated_at {{timestamp}}"}},
+	{"pending_operations", []string{"id {{id}}", "kind varchar(255)", "state varchar(255)", "owner varchar(255)", "instance_uuid varchar(255)", "host varchar(255)",
+		"database varchar(255)", "username varchar(255)", "created_at {{timestamp}}", "updated_at {{timestamp}}"}},
+	{"bindings", []string{"id {{id}}", "uuid varchar(255)", "instance_uuid varchar(255)", "parameters text", "kind varchar(255)", "app_guid varchar(255)",
+		"valid_until {{timestamp}}", "username varchar(255)", "password varchar(255)", "salt varchar(255)", "login_role varchar(255)", "retiring_role varchar(255)",
+		"retire_at {{timestamp}}", "rotated_at {{timestamp}}", "operation varchar(255)", "state varchar(255)", "description text", "created_at {{timestamp}}", "updated_at {{timestamp}}"}},
+}
+
+func createTables(tables []tableSchema) []string {
+	stmts := []string{}
+	for _, table := range tables {
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table.name, strings.Join(table.columns, ", ")))
+	}
+	return stmts
+}
+
+// addMissingColumns adds the columns of tables that existing tables don't
+// have, like AutoMigrate did
+func addMissingColumns(tx *gorm.DB, dialect string, tables []tableSchema) error {
+	for _, table := range tables {
+		rows, err := tx.Raw(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table.name)).Rows()
+		if err != nil {
+			return err
+		}
+		existing, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		has := map[string]bool{}
+		for _, column := range existing {
+			has[column] = true
+		}
+
+		for _, column := range table.columns {
+			name := strings.Trim(strings.Fields(column)[0], `"`)
+			if has[name] {
+				continue
+			}
+			Log.Info("Adding a missing column", "table", table.name, "column", name)
+			stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table.name, column)
+			if err := tx.Exec(migrationTypes[dialect].Replace(stmt)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checksum identifies the statements of the migration. The code of UpFunc
+// and DownFunc isn't part of it.
+func (m *Migration) Checksum() string {
+	h := sha256.New()
+	for _, stmt := range m.Up {
+		fmt.Fprintf(h, "up\x00%s\x00", stmt)
+	}
+	for _, stmt := range m.Down {
+		fmt.Fprintf(h, "down\x00%s\x00", stmt)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Reversible tells if the migration can be rolled back
+func (m *Migration) Reversible() bool {
+	return len(m.Down) > 0 || m.DownFunc != nil
+}
+
+// The states of a migration
+const (
+	MigrationPending = "pending"
+	MigrationApplied = "applied"
+	// Applied, but its statements changed since
+	MigrationChanged = "changed"
+	// Applied by a newer broker
+	MigrationUnknown = "unknown"
+)
+
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	State     string     `json:"state"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// The key of the advisory lock held while migrating, so brokers starting
+// at the same time don't migrate together
+const migrationLockKey = 7317021642
+
+// The types each dialect has for the placeholders of the migrations
+var migrationTypes = map[string]*strings.Replacer{
+	"postgres": strings.NewReplacer("{{id}}", "bigserial PRIMARY KEY", "{{timestamp}}", "timestamp with time zone"),
+	"sqlite3":  strings.NewReplacer("{{id}}", "INTEGER PRIMARY KEY", "{{timestamp}}", "datetime"),
+}
+
+// Migrator applies and rolls back the migrations of the metadata DB
+type Migrator struct {
+	db         *gorm.DB
+	dialect    string
+	settings   *Settings
+	migrations []Migration
+}
+
+func NewMigrator(db *gorm.DB, s *Settings) *Migrator {
+	return &Migrator{db: db, dialect: s.Dialect, settings: s, migrations: Migrations}
+}
+
+// dialectName returns the name of the dialect of db, as gorm.Open takes it.
+// gorm keeps it to itself, the type of the dialect has it. Asking writes to
+// db, so it is only asked once, before db is shared: Settings.Dialect keeps
+// the answer.
+func dialectName(db *gorm.DB) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", db.NewScope(nil).Dialect()), "*gorm.")
+}
+
+// Status lists the migrations, with the ones applied by a newer broker
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied(m.db)
+	if err != nil {
+		return nil, err
+	}
+	return m.status(applied), nil
+}
+
+// Up applies the pending migrations up to the version target, or all of
+// them when target is 0
+func (m *Migrator) Up(target int64) ([]MigrationStatus, error) {
+	if err := m.checkTarget(target); err != nil {
+		return nil, err
+	}
+
+	return m.run(func(tx *gorm.DB, applied map[int64]SchemaMigration) ([]MigrationStatus, error) {
+		done := []MigrationStatus{}
+		for i := range m.migrations {
+			migration := &m.migrations[i]
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			Log.Info("Applying migration", "version", migration.Version, "name", migration.Name)
+			if err := m.exec(tx, migration.Up); err != nil {
+				return nil, fmt.Errorf("Error applying migration %d %s: %s", migration.Version, migration.Name, err)
+			}
+			if migration.UpFunc != nil {
+				if err := migration.UpFunc(tx, m.settings); err != nil {
+					return nil, fmt.Errorf("Error applying migration %d %s: %s", migration.Version, migration.Name, err)
+				}
+			}
+
+			now := time.Now()
+			err := tx.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+				migration.Version, migration.Name, migration.Checksum(), now).Error
+			if err != nil {
+				return nil, err
+			}
+			done = append(done, MigrationStatus{Version: migration.Version, Name: migration.Name, State: MigrationApplied, AppliedAt: &now})
+		}
+		return done, nil
+	})
+}
+
+// Down rolls back the applied migrations after the version target, newest
+// first
+func (m *Migrator) Down(target int64) ([]MigrationStatus, error) {
+	if err := m.checkTarget(target); err != nil {
+		return nil, err
+	}
+
+	return m.run(func(tx *gorm.DB, applied map[int64]SchemaMigration) ([]MigrationStatus, error) {
+		done := []MigrationStatus{}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := &m.migrations[i]
+			if migration.Version <= target {
+				break
+			}
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if !migration.Reversible() {
+				return nil, fmt.Errorf("Migration %d %s can't be rolled back", migration.Version, migration.Name)
+			}
+
+			Log.Info("Rolling back migration", "version", migration.Version, "name", migration.Name)
+			if migration.DownFunc != nil {
+				if err := migration.DownFunc(tx, m.settings); err != nil {
+					return nil, fmt.Errorf("Error rolling back migration %d %s: %s", migration.Version, migration.Name, err)
+				}
+			}
+			if err := m.exec(tx, migration.Down); err != nil {
+				return nil, fmt.Errorf("Error rolling back migration %d %s: %s", migration.Version, migration.Name, err)
+			}
+
+			if err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version).Error; err != nil {
+				return nil, err
+			}
+			done = append(done, MigrationStatus{Version: migration.Version, Name: migration.Name, State: MigrationPending})
+		}
+		return done, nil
+	})
+}
+
+// run calls migrate in a transaction, holding the migration lock, once
+// the applied migrations are checked. Either every change it makes is kept
+// or none.
+func (m *Migrator) run(migrate func(tx *gorm.DB, applied map[int64]SchemaMigration) ([]MigrationStatus, error)) ([]MigrationStatus, error) {
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	done, err := m.runTx(tx, migrate)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return done, tx.Commit().Error
+}
+
+func (m *Migrator) runTx(tx *gorm.DB, migrate func(tx *gorm.DB, applied map[int64]SchemaMigration) ([]MigrationStatus, error)) ([]MigrationStatus, error) {
+	// SQLite locks the whole DB on write already
+	if m.dialect == "postgres" {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockKey).Error; err != nil {
+			return nil, fmt.Errorf("Error taking the migration lock: %s", err)
+		}
+	}
+
+	err := tx.Exec(migrationTypes[m.dialect].Replace(
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name varchar(255), checksum varchar(64), applied_at {{timestamp}})")).Error
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range m.status(applied) {
+		switch status.State {
+		case MigrationChanged:
+			return nil, fmt.Errorf("Migration %d %s changed since it was applied", status.Version, status.Name)
+		case MigrationUnknown:
+			return nil, fmt.Errorf("Migration %d %s was applied by a newer broker", status.Version, status.Name)
+		}
+	}
+
+	return migrate(tx, applied)
+}
+
+func (m *Migrator) exec(tx *gorm.DB, stmts []string) error {
+	for _, stmt := range stmts {
+		if err := tx.Exec(migrationTypes[m.dialect].Replace(stmt)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) checkTarget(target int64) error {
+	if target == 0 {
+		return nil
+	}
+	for _, migration := range m.migrations {
+		if migration.Version == target {
+			return nil
+		}
+	}
+	return fmt.Errorf("There is no migration %d", target)
+}
+
+// applied returns the applied migrations by version
+func (m *Migrator) applied(db *gorm.DB) (map[int64]SchemaMigration, error) {
+	applied := map[int64]SchemaMigration{}
+	if !db.HasTable(SchemaMigration{}) {
+		return applied, nil
+	}
+
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil && err != gorm.RecordNotFound {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func (m *Migrator) status(applied map[int64]SchemaMigration) []MigrationStatus {
+	statuses := []MigrationStatus{}
+	known := map[int64]bool{}
+	for i := range m.migrations {
+		migration := &m.migrations[i]
+		known[migration.Version] = true
+
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name, State: MigrationPending}
+		if row, ok := applied[migration.Version]; ok {
+			status.State = MigrationApplied
+			if row.Checksum != migration.Checksum() {
+				status.State = MigrationChanged
+			}
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	for version, row := range applied {
+		if !known[version] {
+			appliedAt := row.AppliedAt
+			statuses = append(statuses, MigrationStatus{Version: version, Name: row.Name, State: MigrationUnknown, AppliedAt: &appliedAt})
+		}
+	}
+	sort.Sort(statusesByVersion(statuses))
+
+	return statuses
+}
+
+type statusesByVersion []MigrationStatus
+
+func (s statusesByVersion) Len() int           { return len(s) }
+func (s statusesByVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s statusesByVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
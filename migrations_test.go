@@ -0,0 +1,223 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// columns returns the columns of a SQLite table
+func columns(db *gorm.DB, table string) map[string]bool {
+	columns := map[string]bool{}
+	rows, err := db.DB().Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return columns
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			defaultValue     interface{}
+		)
+		rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk)
+		columns[name] = true
+	}
+	return columns
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	db, _ := OpenDB(nil, "test")
+	if _, err := NewMigrator(&db, testSettings()).Up(0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, model := range metadataModels {
+		scope := db.NewScope(model)
+		made := columns(&db, scope.TableName())
+		for _, field := range scope.Fields() {
+			if field.IsNormal && !made[field.DBName] {
+				t.Error("The migrations should make the column", field.DBName, "of", scope.TableName())
+			}
+		}
+	}
+
+	for i := 1; i < len(Migrations); i++ {
+		if Migrations[i].Version <= Migrations[i-1].Version {
+			t.Error("The migrations should be in the order of their versions, and", Migrations[i].Version, "comes after", Migrations[i-1].Version)
+		}
+	}
+}
+
+func TestBaselineCompletesOlderTables(t *testing.T) {
+	db, _ := OpenDB(nil, "test")
+	// The instances table of the first release, made by AutoMigrate
+	db.Exec(`CREATE TABLE "instances" ("id" INTEGER PRIMARY KEY, "uuid" varchar(255), "database" varchar(255), "username" varchar(255), "password" varchar(255),
+		"salt" varchar(255), "plan_id" varchar(255), "org_guid" varchar(255), "space_guid" varchar(255), "created_at" datetime, "updated_at" datetime, "deleted_at" datetime)`)
+	db.Exec(`INSERT INTO instances (uuid, database, plan_id) VALUES ('old_instance', 'db_old', 'the-plan')`)
+
+	if _, err := NewMigrator(&db, testSettings()).Up(0); err != nil {
+		t.Fatal("The baseline should apply to an older DB", err)
+	}
+
+	made := columns(&db, "instances")
+	scope := db.NewScope(Instance{})
+	for _, field := range scope.Fields() {
+		if field.IsNormal && !made[field.DBName] {
+			t.Error("The baseline should add the missing column", field.DBName)
+		}
+	}
+
+	instance := Instance{}
+	if err := db.Where("uuid = ?", "old_instance").First(&instance).Error; err != nil || instance.Database != "db_old" || instance.Host != "" {
+		t.Error("The instances should be kept and readable with the new columns", err, instance)
+	}
+}
+
+// testMigrations make a table, rename one of its columns and backfill a
+// new one
+func testMigrations() []Migration {
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "things",
+			Up:      []string{"CREATE TABLE things (id {{id}}, label varchar(255), created_at {{timestamp}})"},
+			Down:    []string{"DROP TABLE things"},
+		},
+		{
+			Version: 2,
+			Name:    "rename_label",
+			Up:      []string{"ALTER TABLE things RENAME COLUMN label TO name"},
+			Down:    []string{"ALTER TABLE things RENAME COLUMN name TO label"},
+		},
+		{
+			Version: 3,
+			Name:    "backfill_slug",
+			Up:      []string{"ALTER TABLE things ADD COLUMN slug varchar(255)"},
+			Down:    []string{"ALTER TABLE things DROP COLUMN slug"},
+			UpFunc: func(tx *gorm.DB, s *Settings) error {
+				return tx.Exec("UPDATE things SET slug = lower(name)").Error
+			},
+		},
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	db, _ := OpenDB(nil, "test")
+	m := NewMigrator(&db, testSettings())
+	m.migrations = testMigrations()
+
+	if _, err := m.Up(1); err != nil {
+		t.Fatal("Up to 1 failed", err)
+	}
+	db.Exec("INSERT INTO things (label) VALUES ('Old Thing')")
+
+	done, err := m.Up(0)
+	if err != nil {
+		t.Fatal("Up failed", err)
+	}
+	if len(done) != 2 || done[0].Version != 2 || done[1].Version != 3 {
+		t.Error("Up should apply the pending migrations in order and it applied", done)
+	}
+	var slug string
+	db.Raw("SELECT slug FROM things WHERE name = 'Old Thing'").Row().Scan(&slug)
+	if slug != "old thing" {
+		t.Error("The column should be renamed and the new one backfilled and the slug is", slug)
+	}
+
+	if done, _ := m.Up(0); len(done) != 0 {
+		t.Error("Up should not apply a migration twice and it applied", done)
+	}
+
+	done, err = m.Down(1)
+	if err != nil {
+		t.Fatal("Down failed", err)
+	}
+	if len(done) != 2 || done[0].Version != 3 || done[1].Version != 2 {
+		t.Error("Down should roll back the newest migrations first and it rolled back", done)
+	}
+	var label string
+	db.Raw("SELECT label FROM things").Row().Scan(&label)
+	if label != "Old Thing" {
+		t.Error("The column should get its old name back with its data and it has", label)
+	}
+
+	statuses, _ := m.Status()
+	states := []string{}
+	for _, status := range statuses {
+		states = append(states, status.State)
+	}
+	if strings.Join(states, ",") != "applied,pending,pending" {
+		t.Error("The status should show what is applied and it shows", states)
+	}
+}
+
+func TestMigratorChecks(t *testing.T) {
+	db, _ := OpenDB(nil, "test")
+	m := NewMigrator(&db, testSettings())
+	m.migrations = testMigrations()
+	m.Up(2)
+
+	// A migration that fails leaves the DB as it was
+	m.migrations[2].UpFunc = func(tx *gorm.DB, s *Settings) error {
+		return tx.Exec("UPDATE nowhere SET slug = 1").Error
+	}
+	if _, err := m.Up(0); err == nil {
+		t.Error("Up should fail when a migration fails")
+	}
+	if statuses, _ := m.Status(); statuses[2].State != MigrationPending || columns(&db, "things")["slug"] {
+		t.Error("A failed migration should be rolled back")
+	}
+
+	m.migrations[1].Up = []string{"ALTER TABLE things RENAME COLUMN label TO title"}
+	if _, err := m.Up(0); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Error("Up should refuse to run when an applied migration changed and it returned", err)
+	}
+
+	m.migrations = testMigrations()[:1]
+	if _, err := m.Up(0); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Error("Up should refuse to run when the DB has migrations it doesn't know and it returned", err)
+	}
+	if statuses, _ := m.Status(); len(statuses) != 2 || statuses[1].State != MigrationUnknown {
+		t.Error("The status should show the unknown migrations and it shows", statuses)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	s := testSettings()
+	db, _ := OpenDB(nil, "test")
+
+	var out bytes.Buffer
+	if err := runCommand([]string{"migrate", "status", "-json"}, &db, nil, s, &out); err != nil {
+		t.Fatal("migrate status failed", err)
+	}
+	var statuses []MigrationStatus
+	json.Unmarshal(out.Bytes(), &statuses)
+	if len(statuses) != len(Migrations) || statuses[0].State != MigrationPending {
+		t.Error("migrate status should list the pending migrations and it printed", out.String())
+	}
+
+	out.Reset()
+	if err := runCommand([]string{"migrate", "up"}, &db, nil, s, &out); err != nil {
+		t.Fatal("migrate up failed", err)
+	}
+	if !strings.Contains(out.String(), "baseline") || !strings.Contains(out.String(), MigrationApplied) {
+		t.Error("migrate up should print the applied migrations and it printed", out.String())
+	}
+
+	if err := runCommand([]string{"migrate", "down", "-to", "1"}, &db, nil, s, &out); err != nil {
+		t.Error("migrate down should roll back the migrations after the baseline and it returned", err)
+	}
+	if err := runCommand([]string{"migrate", "down"}, &db, nil, s, &out); err == nil {
+		t.Error("migrate down should refuse to roll back the baseline")
+	}
+	if err := runCommand([]string{"migrate", "up", "-to", "999"}, &db, nil, s, &out); err == nil {
+		t.Error("migrate up should refuse an unknown version")
+	}
+	if err := runCommand([]string{"migrate", "sideways"}, &db, nil, s, &out); err == nil {
+		t.Error("migrate should refuse an unknown action")
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"encoding/base64"
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -17,23 +18,51 @@ type Instance struct {
 	Password string `sql:"size(255)"`
 	Salt     string `sql:"size(255)"`
 
+	ServiceId string `sql:"size(255)"`
 	PlanId    string `sql:"size(255)"`
 	OrgGuid   string `sql:"size(255)"`
 	SpaceGuid string `sql:"size(255)"`
 
+	// The parameters of the provision request, as JSON
+	Parameters string `sql:"type:text"`
+
+	// Name of the backing host the database lives on
+	Host string `sql:"size(255)"`
+
+	StorageState string `sql:"size(255)"`
+	StorageBytes int64
+
+	// Password rotation switches the login between Username, which owns
+	// the database, and its twin. The previous login keeps working until
+	// RetireAt.
+	LoginRole    string `sql:"size(255)"`
+	RetiringRole string `sql:"size(255)"`
+	RetireAt     time.Time
+	RotatedAt    time.Time
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt time.Time
 }
 
-func (i *Instance) SetPassword(password, key string) error {
-	if i.Salt == "" {
-		return errors.New("Salt has to be set before writing the password")
+// LoginUsername returns the role apps log in with
+func (i *Instance) LoginUsername() string {
+	if i.LoginRole != "" {
+		return i.LoginRole
 	}
+	return i.Username
+}
 
-	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
+// Roles returns the role of the instance and its twin, once it has one
+func (i *Instance) Roles() []string {
+	if i.RotatedAt.IsZero() {
+		return []string{i.Username}
+	}
+	return []string{i.Username, TwinRole(i.Username)}
+}
 
-	encrypted, err := Encrypt(password, key, iv)
+func (i *Instance) SetPassword(password, key string) error {
+	encrypted, err := encryptPassword(password, i.Salt, key)
 	if err != nil {
 		return err
 	}
@@ -44,16 +73,221 @@ func (i *Instance) SetPassword(password, key string) error {
 }
 
 func (i *Instance) GetPassword(key string) (string, error) {
-	if i.Salt == "" || i.Password == "" {
+	return decryptPassword(i.Password, i.Salt, key)
+}
+
+func encryptPassword(password, salt, key string) (string, error) {
+	if salt == "" {
+		return "", errors.New("Salt has to be set before writing the password")
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(salt)
+
+	return Encrypt(password, key, iv)
+}
+
+func decryptPassword(encrypted, salt, key string) (string, error) {
+	if salt == "" || encrypted == "" {
 		return "", errors.New("Salt and password has to be set before writing the password")
 	}
 
-	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
+	iv, _ := base64.StdEncoding.DecodeString(salt)
+
+	return Decrypt(encrypted, key, iv)
+}
+
+// Quota limits the number of instances that can exist for an org, a space
+// or a plan. A quota with an empty Guid is the default for its Scope.
+type Quota struct {
+	Id    int64
+	Scope string `sql:"size(255)"`
+	Guid  string `sql:"size(255)"`
+	Limit int64
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// StorageEvent records every change of the storage state of an instance
+type StorageEvent struct {
+	Id           int64
+	InstanceUuid string `sql:"size(255)"`
+	State        string `sql:"size(255)"`
+	Bytes        int64
+	LimitBytes   int64
+
+	CreatedAt time.Time
+}
+
+// Host is a shared server instances can be placed on. Its password is
+// encrypted like the instance passwords.
+type Host struct {
+	Id       int64
+	Name     string `sql:"size(255)"`
+	Url      string `sql:"size(255)"`
+	Port     string `sql:"size(255)"`
+	DbName   string `sql:"size(255)"`
+	Username string `sql:"size(255)"`
+	Password string `sql:"size(255)"`
+	Salt     string `sql:"size(255)"`
+	Sslmode  string `sql:"size(255)"`
+
+	SslRootCert   string `sql:"size(255)"`
+	SslCert       string `sql:"size(255)"`
+	SslKey        string `sql:"size(255)"`
+	SslServerName string `sql:"size(255)"`
+
+	// Comma separated ids of the plans pinned to the host
+	Plans string `sql:"type:text"`
+
+	// Draining hosts keep their instances but get no new ones
+	Draining bool
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (h *Host) SetPassword(password, key string) error {
+	encrypted, err := encryptPassword(password, h.Salt, key)
+	if err != nil {
+		return err
+	}
+
+	h.Password = encrypted
+
+	return nil
+}
+
+func (h *Host) GetPassword(key string) (string, error) {
+	return decryptPassword(h.Password, h.Salt, key)
+}
+
+func (h *Host) PlanIds() []string {
+	if h.Plans == "" {
+		return nil
+	}
+	return strings.Split(h.Plans, ",")
+}
+
+// Rds returns the connection settings of the host
+func (h *Host) Rds(key string) (*RDS, error) {
+	var password string
+	if h.Password != "" {
+		var err error
+		password, err = h.GetPassword(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RDS{
+		Url:      h.Url,
+		Port:     h.Port,
+		DbName:   h.DbName,
+		Username: h.Username,
+		Password: password,
+		Sslmode:  h.Sslmode,
+
+		SslRootCert:   h.SslRootCert,
+		SslCert:       h.SslCert,
+		SslKey:        h.SslKey,
+		SslServerName: h.SslServerName,
+	}, nil
+}
+
+// PendingOperation records a provision or deprovision while it runs
+// DDL on a host, so it can be cleaned up or finished if the broker stops
+// halfway
+type PendingOperation struct {
+	Id           int64
+	Kind         string `sql:"size(255)"`
+	State        string `sql:"size(255)"`
+	Owner        string `sql:"size(255)"`
+	InstanceUuid string `sql:"size(255)"`
+	Host         string `sql:"size(255)"`
+	Database     string `sql:"size(255)"`
+	Username     string `sql:"size(255)"`
+
+	// What a provision counts against
+	OrgGuid   string `sql:"size(255)"`
+	SpaceGuid string `sql:"size(255)"`
+	PlanId    string `sql:"size(255)"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Binding is a binding of an instance to an app
+type Binding struct {
+	Id           int64
+	Uuid         string `sql:"size(255)"`
+	InstanceUuid string `sql:"size(255)"`
+
+	// The parameters of the bind request, as JSON
+	Parameters string `sql:"type:text"`
+
+	// BindingApp or BindingServiceKey, and the app of the former
+	Kind    string `sql:"size(255)"`
+	AppGuid string `sql:"size(255)"`
+	// When the role of the binding stops working, if ever
+	ValidUntil time.Time
 
-	decrypted, err := Decrypt(i.Password, key, iv)
+	// The role of read-only bindings and service keys. Other bindings use
+	// the role of the instance and leave these empty.
+	Username string `sql:"size(255)"`
+	Password string `sql:"size(255)"`
+	Salt     string `sql:"size(255)"`
+
+	// Like the ones of Instance, for the role of the binding
+	LoginRole    string `sql:"size(255)"`
+	RetiringRole string `sql:"size(255)"`
+	RetireAt     time.Time
+	RotatedAt    time.Time
+
+	// The last bind or unbind and how it went
+	Operation   string `sql:"size(255)"`
+	State       string `sql:"size(255)"`
+	Description string `sql:"type:text"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (b *Binding) SetPassword(password, key string) error {
+	encrypted, err := encryptPassword(password, b.Salt, key)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return decrypted, nil
+	b.Password = encrypted
+
+	return nil
+}
+
+func (b *Binding) GetPassword(key string) (string, error) {
+	return decryptPassword(b.Password, b.Salt, key)
+}
+
+// LoginUsername returns the role apps log in with
+func (b *Binding) LoginUsername() string {
+	if b.LoginRole != "" {
+		return b.LoginRole
+	}
+	return b.Username
+}
+
+// Roles returns the role of the binding and its twin, once it has one
+func (b *Binding) Roles() []string {
+	if b.RotatedAt.IsZero() {
+		return []string{b.Username}
+	}
+	return []string{b.Username, TwinRole(b.Username)}
+}
+
+// SchemaMigration records a migration applied to the metadata DB
+type SchemaMigration struct {
+	Version   int64
+	Name      string `sql:"size(255)"`
+	Checksum  string `sql:"size(64)"`
+	AppliedAt time.Time
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"fmt"
+	"time"
+)
+
+const (
+	StorageOk       = "ok"
+	StorageWarning  = "warning"
+	StorageReadOnly = "read_only"
+)
+
+// StorageMonitor compares the size of every instance database with the
+// storage limit of its plan. Over the limit the database is read-only until
+// its usage drops back under it.
+type StorageMonitor struct {
+	db          *gorm.DB
+	hosts       *HostRegistry
+	interval    time.Duration
+	warnPercent int64
+
+	// Returns the size of the instance database in bytes
+	size func(instance *Instance) (int64, error)
+}
+
+func NewStorageMonitor(db *gorm.DB, hosts *HostRegistry, s *Settings) *StorageMonitor {
+	monitor := &StorageMonitor{
+		db:          db,
+		hosts:       hosts,
+		interval:    s.StorageCheckInterval,
+		warnPercent: s.StorageWarnPercent,
+	}
+	monitor.size = monitor.databaseSize
+
+	return monitor
+}
+
+func (m *StorageMonitor) databaseSize(instance *Instance) (int64, error) {
+	host, err := m.hosts.HostFor(instance)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = host.DB.Raw("SELECT pg_database_size(?)", instance.Database).Row().Scan(&size)
+	return size, err
+}
+
+// Run checks the instances every interval until stop is closed
+func (m *StorageMonitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.CheckAll()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *StorageMonitor) CheckAll() {
+	var instances []Instance
+	m.db.Find(&instances)
+
+	for i := range instances {
+		if err := m.Check(&instances[i]); err != nil {
+			Log.Error("Error checking the storage", err, "instance_id", instances[i].Uuid)
+		}
+	}
+}
+
+// Check measures the database of instance and moves it to the storage state
+// that matches its usage
+func (m *StorageMonitor) Check(instance *Instance) error {
+	plan := FindPlan(instance.PlanId)
+	if plan == nil || plan.StorageLimitMB <= 0 {
+		return nil
+	}
+	limit := plan.StorageLimitMB * 1024 * 1024
+
+	size, err := m.size(instance)
+	if err != nil {
+		return err
+	}
+
+	state := StorageOk
+	if size >= limit {
+		state = StorageReadOnly
+	} else if size*100 >= limit*m.warnPercent {
+		state = StorageWarning
+	}
+
+	instance.StorageBytes = size
+	if state == instance.StorageState || (instance.StorageState == "" && state == StorageOk) {
+		m.db.Model(instance).UpdateColumn("storage_bytes", size)
+		return nil
+	}
+
+	if state == StorageReadOnly {
+		err = m.setReadOnly(instance)
+	} else if instance.StorageState == StorageReadOnly {
+		err = m.unsetReadOnly(instance)
+	}
+	if err != nil {
+		return err
+	}
+
+	Log.Info("Storage state changed", "instance_id", instance.Uuid,
+		"from", instance.StorageState, "to", state, "bytes", size, "limit_bytes", limit)
+
+	instance.StorageState = state
+	m.db.Model(instance).UpdateColumns(map[string]interface{}{
+		"storage_state": state,
+		"storage_bytes": size,
+	})
+	m.db.Create(&StorageEvent{
+		InstanceUuid: instance.Uuid,
+		State:        state,
+		Bytes:        size,
+		LimitBytes:   limit,
+	})
+
+	return nil
+}
+
+// setReadOnly makes the transactions of the instance database read-only
+// unless a session asks for a read-write one, which is how tenants delete
+// data to get back under the limit, and takes away creating schemas and
+// temporary tables. The sessions are closed so they reconnect read-only.
+func (m *StorageMonitor) setReadOnly(instance *Instance) error {
+	host, err := m.hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+
+	return execAllWith(hostExec, host.DB, Log.With("instance_id", instance.Uuid), []string{
+		fmt.Sprintf("ALTER DATABASE %s SET default_transaction_read_only = on", instance.Database),
+		fmt.Sprintf("REVOKE CREATE, TEMPORARY ON DATABASE %s FROM PUBLIC, %s", instance.Database, instance.Username),
+		fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = %s", quoteLiteral(instance.Database)),
+	})
+}
+
+// unsetReadOnly undoes setReadOnly. PUBLIC doesn't get its temporary tables
+// back, like with read-only bindings.
+func (m *StorageMonitor) unsetReadOnly(instance *Instance) error {
+	host, err := m.hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+
+	return execAllWith(hostExec, host.DB, Log.With("instance_id", instance.Uuid), []string{
+		fmt.Sprintf("ALTER DATABASE %s RESET default_transaction_read_only", instance.Database),
+		fmt.Sprintf("GRANT CREATE, TEMPORARY ON DATABASE %s TO %s", instance.Database, instance.Username),
+	})
+}
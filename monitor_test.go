@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStorageMonitor(t *testing.T) {
+	setup()
+
+	plan := BuildCatalog()[0].Plans[0]
+	limit := plan.StorageLimitMB * 1024 * 1024
+
+	instance := Instance{Uuid: "monitored", Database: "dbmonitored", Username: "umonitored", PlanId: plan.Id}
+	DB.Save(&instance)
+
+	var size int64
+	monitor := &StorageMonitor{db: &DB, hosts: Hosts, warnPercent: 80}
+	monitor.size = func(*Instance) (int64, error) { return size, nil }
+
+	size = limit / 2
+	if err := monitor.Check(&instance); err != nil || instance.StorageState != "" {
+		t.Error("An instance under the warning threshold should stay ok", instance.StorageState, err)
+	}
+
+	size = limit * 9 / 10
+	if err := monitor.Check(&instance); err != nil || instance.StorageState != StorageWarning {
+		t.Error("An instance over the warning threshold should get a warning", instance.StorageState, err)
+	}
+
+	var events []StorageEvent
+	DB.Where("instance_uuid = ?", "monitored").Find(&events)
+	if len(events) != 1 || events[0].State != StorageWarning || events[0].Bytes != size {
+		t.Error("The state change should be recorded", events)
+	}
+
+	saved := Instance{}
+	DB.Where("uuid = ?", "monitored").First(&saved)
+	if saved.StorageState != StorageWarning || saved.StorageBytes != size {
+		t.Error("The storage state should be saved", saved.StorageState, saved.StorageBytes)
+	}
+
+	// Over the limit the database is read-only, and its roles can still
+	// connect
+	hostStatements = nil
+	size = limit * 2
+	if err := monitor.Check(&instance); err != nil || instance.StorageState != StorageReadOnly {
+		t.Error("An instance over the limit should be read-only", instance.StorageState, err)
+	}
+	all := strings.Join(hostStatements, ";")
+	for _, statement := range []string{
+		"ALTER DATABASE dbmonitored SET default_transaction_read_only = on",
+		"REVOKE CREATE, TEMPORARY ON DATABASE dbmonitored FROM PUBLIC, umonitored",
+		"pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = 'dbmonitored'",
+	} {
+		if !strings.Contains(all, statement) {
+			t.Error("Making the instance read-only should run", statement, "and it ran", hostStatements)
+		}
+	}
+	if strings.Contains(all, "CONNECTION LIMIT") {
+		t.Error("The roles should still be able to connect and the statements were", hostStatements)
+	}
+
+	hostStatements = nil
+	size = limit / 2
+	if err := monitor.Check(&instance); err != nil || instance.StorageState != StorageOk {
+		t.Error("An instance back under the limit should be writable", instance.StorageState, err)
+	}
+	all = strings.Join(hostStatements, ";")
+	for _, statement := range []string{
+		"ALTER DATABASE dbmonitored RESET default_transaction_read_only",
+		"GRANT CREATE, TEMPORARY ON DATABASE dbmonitored TO umonitored",
+	} {
+		if !strings.Contains(all, statement) {
+			t.Error("Making the instance writable should run", statement, "and it ran", hostStatements)
+		}
+	}
+
+	// Without a plan limit there is nothing to check
+	other := Instance{Uuid: "unlimited", PlanId: "no-such-plan"}
+	size = limit * 2
+	if err := monitor.Check(&other); err != nil || other.StorageState != "" {
+		t.Error("Instances without a storage limit should not be checked", other.StorageState, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"fmt"
+	"regexp"
+)
+
+// RoleProfile holds the resource limits a plan applies to the role of each
+// instance. Empty values leave the server defaults in place.
+type RoleProfile struct {
+	ConnectionLimit                 int    `yaml:"connection_limit"`
+	StatementTimeout                string `yaml:"statement_timeout"`
+	IdleInTransactionSessionTimeout string `yaml:"idle_in_transaction_session_timeout"`
+	WorkMem                         string `yaml:"work_mem"`
+}
+
+// The settings a profile can change, with the values they take. Anything
+// else could hand tenants more than their plan.
+var (
+	durationSetting = regexp.MustCompile(`^[0-9]+(us|ms|s|min|h|d)?$`)
+	memorySetting   = regexp.MustCompile(`^[0-9]+(B|kB|MB|GB|TB)?$`)
+
+	profileParameters = []struct {
+		name   string
+		values *regexp.Regexp
+	}{
+		{"statement_timeout", durationSetting},
+		{"idle_in_transaction_session_timeout", durationSetting},
+		{"work_mem", memorySetting},
+	}
+)
+
+// parameters returns the value of every parameter of the profile
+func (rp RoleProfile) parameters() map[string]string {
+	return map[string]string{
+		"statement_timeout":                   rp.StatementTimeout,
+		"idle_in_transaction_session_timeout": rp.IdleInTransactionSessionTimeout,
+		"work_mem":                            rp.WorkMem,
+	}
+}
+
+// Check reports the first value of the profile the server should not get
+func (rp RoleProfile) Check() error {
+	if rp.ConnectionLimit < 0 {
+		return fmt.Errorf("connection_limit has to be 0 or more")
+	}
+
+	values := rp.parameters()
+	for _, param := range profileParameters {
+		if value := values[param.name]; value != "" && !param.values.MatchString(value) {
+			return fmt.Errorf("%s %q is not allowed", param.name, value)
+		}
+		delete(values, param.name)
+	}
+	for name := range values {
+		return fmt.Errorf("%s is not a parameter profiles can set", name)
+	}
+	return nil
+}
+
+// Statements returns the SQL that applies the profile to username. It also
+// resets whatever the profile leaves empty, so it can be run again when an
+// instance changes plans.
+func (rp RoleProfile) Statements(username string) []string {
+	limit := rp.ConnectionLimit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	statements := []string{
+		fmt.Sprintf("ALTER ROLE %s CONNECTION LIMIT %d", username, limit),
+	}
+
+	values := rp.parameters()
+	for _, param := range profileParameters {
+		if value := values[param.name]; value == "" {
+			statements = append(statements, fmt.Sprintf("ALTER ROLE %s RESET %s", username, param.name))
+		} else {
+			statements = append(statements, fmt.Sprintf("ALTER ROLE %s SET %s = %s", username, param.name, quoteLiteral(value)))
+		}
+	}
+
+	return statements
+}
+
+// ApplyProfile sets the resource profile of the instance plan on its roles
+// and on those of its bindings
+func ApplyProfile(db *gorm.DB, instance *Instance, bindings []Binding, l *Logger) error {
+	return execAllWith(hostExec, db, l, ProfileStatements(instance, bindings))
+}
+
+// ProfileStatements returns the SQL that ApplyProfile runs
+func ProfileStatements(instance *Instance, bindings []Binding) []string {
+	statements := []string{}
+	for _, role := range AllRoles(instance, bindings) {
+		statements = append(statements, InstanceProfile(instance).Statements(role)...)
+	}
+	return statements
+}
+
+// AllRoles returns the roles of the instance and of its bindings
+func AllRoles(instance *Instance, bindings []Binding) []string {
+	roles := instance.Roles()
+	for i := range bindings {
+		roles = append(roles, bindings[i].Roles()...)
+	}
+	return roles
+}
+
+// InstanceProfile returns the profile of the instance plan
+func InstanceProfile(instance *Instance) RoleProfile {
+	if plan := FindPlan(instance.PlanId); plan != nil {
+		return plan.Profile
+	}
+	return RoleProfile{}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfileStatements(t *testing.T) {
+	profile := RoleProfile{ConnectionLimit: 5, StatementTimeout: "30s"}
+
+	expected := []string{
+		"ALTER ROLE uabc CONNECTION LIMIT 5",
+		"ALTER ROLE uabc SET statement_timeout = '30s'",
+		"ALTER ROLE uabc RESET idle_in_transaction_session_timeout",
+		"ALTER ROLE uabc RESET work_mem",
+	}
+	if statements := profile.Statements("uabc"); !reflect.DeepEqual(statements, expected) {
+		t.Error("The profile should set and reset every limit and it returned", statements)
+	}
+
+	// An empty profile lifts the connection limit
+	if statements := (RoleProfile{}).Statements("uabc"); statements[0] != "ALTER ROLE uabc CONNECTION LIMIT -1" {
+		t.Error("An empty profile should remove the connection limit and it returned", statements[0])
+	}
+}
+
+func TestProfileCheck(t *testing.T) {
+	if err := (RoleProfile{ConnectionLimit: 5, StatementTimeout: "30s", IdleInTransactionSessionTimeout: "10min", WorkMem: "4MB"}).Check(); err != nil {
+		t.Error("The profile should be valid", err)
+	}
+
+	for _, profile := range []RoleProfile{
+		{ConnectionLimit: -2},
+		{StatementTimeout: "30s'; DROP ROLE admin; --"},
+		{WorkMem: "lots"},
+		{IdleInTransactionSessionTimeout: "4MB"},
+	} {
+		if err := profile.Check(); err == nil {
+			t.Error("The profile should be refused", profile)
+		}
+	}
+
+	// Whatever gets through is quoted
+	statements := RoleProfile{WorkMem: `4MB'\`}.Statements("uabc")
+	if statements[3] != `ALTER ROLE uabc SET work_mem = E'4MB''\\'` {
+		t.Error("The value should be quoted and it is", statements[3])
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"errors"
+	"fmt"
+)
+
+const (
+	QuotaScopeOrg   = "org"
+	QuotaScopeSpace = "space"
+	QuotaScopePlan  = "plan"
+)
+
+// The instance columns each quota scope is counted against
+var quotaColumns = map[string]string{
+	QuotaScopeOrg:   "org_guid",
+	QuotaScopeSpace: "space_guid",
+	QuotaScopePlan:  "plan_id",
+}
+
+// A limit lower than zero lifts the default for a single org, space or plan
+const QuotaUnlimited = -1
+
+type QuotaError struct {
+	Scope string
+	Guid  string
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("The %s %s has reached its quota of %d instances", e.Scope, e.Guid, e.Limit)
+}
+
+func ValidQuotaScope(scope string) bool {
+	_, ok := quotaColumns[scope]
+	return ok
+}
+
+// FindQuota returns the quota that applies to guid: its own override if
+// there is one, otherwise the default for the scope.
+// It returns nil when neither exists.
+func FindQuota(db *gorm.DB, scope, guid string) *Quota {
+	quota := Quota{}
+	db.Where("scope = ? AND guid = ?", scope, guid).First(&quota)
+	if quota.Id == 0 && guid != "" {
+		db.Where("scope = ? AND guid = ?", scope, "").First(&quota)
+	}
+
+	if quota.Id == 0 {
+		return nil
+	}
+	return &quota
+}
+
+// QuotaUsage counts the instances that count against guid's quota, along
+// with the provisions in progress
+func QuotaUsage(db *gorm.DB, scope, guid string) int64 {
+	var instances, provisions int64
+	db.Model(Instance{}).Where(quotaColumns[scope]+" = ?", guid).Count(&instances)
+	db.Model(PendingOperation{}).
+		Where(quotaColumns[scope]+" = ? AND kind = ? AND state = ?", guid, OperationProvision, OperationInProgress).
+		Where("instance_uuid NOT IN (SELECT uuid FROM instances)").
+		Count(&provisions)
+	return instances + provisions
+}
+
+// The key of the advisory lock held while the quotas are checked, so
+// concurrent provisions are counted one after the other
+const quotaLockKey = 7317021644
+
+// ReserveQuotas checks the quotas of instance and records its provision,
+// which counts against them from then on, in a transaction. With Postgres
+// the other checks wait for it.
+func ReserveQuotas(db *gorm.DB, dialect string, instance *Instance) (*PendingOperation, error) {
+	tx := db.Begin()
+	if dialect == "postgres" {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", quotaLockKey).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Error taking the quota lock: %s", err)
+		}
+	}
+
+	if err := CheckQuotas(tx, instance); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	op := StartOperation(tx, OperationProvision, instance)
+	if op.Id == 0 {
+		tx.Rollback()
+		return nil, errors.New("The provision could not be recorded")
+	}
+	return op, tx.Commit().Error
+}
+
+// CheckQuotas makes sure that one more instance fits in the org, space and
+// plan quotas of instance
+func CheckQuotas(db *gorm.DB, instance *Instance) error {
+	guids := map[string]string{
+		QuotaScopeOrg:   instance.OrgGuid,
+		QuotaScopeSpace: instance.SpaceGuid,
+		QuotaScopePlan:  instance.PlanId,
+	}
+
+	for _, scope := range []string{QuotaScopeOrg, QuotaScopeSpace, QuotaScopePlan} {
+		if err := CheckQuota(db, scope, guids[scope]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckQuota makes sure that one more instance fits in the quota of guid
+func CheckQuota(db *gorm.DB, scope, guid string) error {
+	if guid == "" {
+		return nil
+	}
+
+	quota := FindQuota(db, scope, guid)
+	if quota == nil || quota.Limit < 0 {
+		return nil
+	}
+
+	if QuotaUsage(db, scope, guid) >= quota.Limit {
+		return &QuotaError{scope, guid, quota.Limit}
+	}
+
+	return nil
+}
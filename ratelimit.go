@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/auth"
+	"github.com/martini-contrib/render"
+
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimitSettings protects the hosts from clients that send too much. Zero
+// turns a limit off.
+type LimitSettings struct {
+	// Requests each client can make per second on the broker API, and in
+	// a burst
+	RequestsPerSecond float64
+	Burst             int
+
+	// Provisions and deprovisions that can run at the same time
+	MaxConcurrentProvisions int
+}
+
+// How long clients are told to wait when too many provisions are running
+var ProvisionRetryAfter = 5 * time.Second
+
+// How long an unused bucket is kept
+const bucketIdleTime = 10 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter gives every client a token bucket, filled at rate tokens per
+// second up to burst
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of client. Without one it returns
+// how long until the next token.
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// sweep forgets the clients that have been quiet for a while, their
+// buckets being full again anyway
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < bucketIdleTime {
+		return
+	}
+	rl.swept = now
+	for client, b := range rl.buckets {
+		if now.Sub(b.last) > bucketIdleTime {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// Limits holds the limits of the broker API
+type Limits struct {
+	rate       *RateLimiter
+	provisions chan struct{}
+	metrics    *Metrics
+}
+
+func NewLimits(ls LimitSettings, metrics *Metrics) *Limits {
+	limits := &Limits{metrics: metrics}
+	if ls.RequestsPerSecond > 0 {
+		limits.rate = NewRateLimiter(ls.RequestsPerSecond, ls.Burst)
+	}
+	if ls.MaxConcurrentProvisions > 0 {
+		limits.provisions = make(chan struct{}, ls.MaxConcurrentProvisions)
+	}
+	return limits
+}
+
+// RateLimit answers 429 to the clients over their rate. It goes after the
+// authentication, which tells who the client is.
+func (l *Limits) RateLimit() martini.Handler {
+	return func(user auth.User, r render.Render, rw http.ResponseWriter, req *http.Request) {
+		if l.rate == nil {
+			return
+		}
+		if ok, wait := l.rate.Allow(string(user)); !ok {
+			Log.Info("Rate limited", "client", string(user), "path", req.URL.Path)
+			l.reject(r, rw, "rate", wait, "Too many requests, retry later")
+		}
+	}
+}
+
+// Provision lets a limited number of provisions and deprovisions run at
+// once and answers 429 to the others
+func (l *Limits) Provision() martini.Handler {
+	return func(c martini.Context, r render.Render, rw http.ResponseWriter, req *http.Request) {
+		if l.provisions == nil {
+			return
+		}
+
+		select {
+		case l.provisions <- struct{}{}:
+			defer func() { <-l.provisions }()
+			c.Next()
+		default:
+			Log.Info("Too many provisions running", "path", req.URL.Path, "max", cap(l.provisions))
+			l.reject(r, rw, "concurrency", ProvisionRetryAfter, "Too many operations running, retry later")
+		}
+	}
+}
+
+func (l *Limits) reject(r render.Render, rw http.ResponseWriter, reason string, wait time.Duration, description string) {
+	l.metrics.ObserveThrottled(reason)
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	r.JSON(429, Response{description})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(1, 2)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("cf"); !ok {
+			t.Error("The burst should be allowed")
+		}
+	}
+	ok, wait := rl.Allow("cf")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Error("The request over the burst should wait for the next token and it got", ok, wait)
+	}
+	if ok, _ := rl.Allow("other"); !ok {
+		t.Error("Each client should have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := rl.Allow("cf"); !ok {
+		t.Error("The bucket should be filled again over time")
+	}
+}
+
+func TestRateLimitRoutes(t *testing.T) {
+	s := testSettings()
+	s.Limits = LimitSettings{RequestsPerSecond: 0.01, Burst: 2}
+	s.Auth.Credentials = []Credential{{Username: "cf2", PasswordHash: hashPassword(t, "cf2-pass"), Role: RolePlatform}}
+	m, err := App(s, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		res, _ = doRequest(m, "/v2/catalog", "GET", true, nil)
+	}
+	if res.Code != 429 || res.Header().Get("Retry-After") == "" {
+		t.Error("The request over the limit should return 429 with a Retry-After and it returned", res.Code, res.Header())
+	}
+
+	if code := requestAs(m, "GET", "/v2/catalog", "cf2", "cf2-pass", nil); code != 200 {
+		t.Error("Another client should not be limited and it got", code)
+	}
+	if res, _ := doRequest(m, "/admin/quotas", "GET", true, nil); res.Code != 200 {
+		t.Error("The admin API should not be limited and it returned", res.Code)
+	}
+}
+
+func TestProvisionCap(t *testing.T) {
+	metrics := NewMetrics()
+	limits := NewLimits(LimitSettings{MaxConcurrentProvisions: 1}, metrics)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Put("/provision", limits.Provision(), func() string {
+		started <- true
+		<-release
+		return "done"
+	})
+
+	first := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/provision", nil)
+		m.ServeHTTP(res, req)
+		first <- res.Code
+	}()
+	<-started
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/provision", nil)
+	m.ServeHTTP(res, req)
+	if res.Code != 429 || res.Header().Get("Retry-After") != "5" {
+		t.Error("A provision over the cap should return 429 with a Retry-After and it returned", res.Code, res.Header())
+	}
+
+	release <- true
+	if code := <-first; code != 200 {
+		t.Error("The running provision should finish and it returned", code)
+	}
+
+	go func() { <-started; release <- true }()
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/provision", nil)
+	m.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Error("A provision after the previous one finished should run and it returned", res.Code)
+	}
+
+	if metrics.throttled["concurrency"] != 1 {
+		t.Error("The rejected provision should be counted and the count is", metrics.throttled)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"context"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How often the rotator looks for roles to rotate or retire
+var RotationCheckInterval = 10 * time.Minute
+
+// The rotation of a role whose previous login still works
+var ErrRotationInProgress = errors.New("The previous rotation is still in its overlap window")
+
+// The key of the advisory locks taken while rotating, along with the id of
+// the instance
+const rotationLockKey = 731702
+
+// lockRotation waits until no other rotation of instance runs, in this
+// broker or another, and keeps them waiting until unlock is called
+func (cr *CredentialRotator) lockRotation(instance *Instance) (unlock func(), err error) {
+	ctx := context.Background()
+	conn, err := cr.db.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1, $2)", rotationLockKey, int32(instance.Id)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error taking the rotation lock: %s", err)
+	}
+	return func() {
+		conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1, $2)", rotationLockKey, int32(instance.Id))
+		conn.Close()
+	}, nil
+}
+
+// TwinRole returns the name of the role that takes turns with role as the
+// login of an instance or binding
+func TwinRole(role string) string {
+	return role + "_b"
+}
+
+// nextLoginRole returns the role to switch the login to
+func nextLoginRole(primary, login string) string {
+	if login == "" || login == primary {
+		return TwinRole(primary)
+	}
+	return primary
+}
+
+// RotationStatements returns the SQL that makes next a login with password.
+// The twin is created when it doesn't exist yet, as a member of primary
+// that acts as primary, and gets the extra statements.
+func RotationStatements(primary, next, password string, extra []string) []string {
+	statements := []string{}
+	if next != primary {
+		statements = append(statements,
+			fmt.Sprintf("DO $$BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '%s') THEN CREATE ROLE %s IN ROLE %s; END IF; END$$", next, next, primary),
+			fmt.Sprintf("ALTER ROLE %s SET ROLE %s", next, primary))
+		statements = append(statements, extra...)
+	}
+	return append(statements, fmt.Sprintf("ALTER ROLE %s WITH LOGIN PASSWORD '%s'", next, password))
+}
+
+// RetireStatements returns the SQL that stops role from logging in
+func RetireStatements(role string) []string {
+	return []string{
+		fmt.Sprintf("ALTER ROLE %s WITH NOLOGIN PASSWORD NULL", role),
+		fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = '%s'", role),
+	}
+}
+
+// CredentialRotator changes the passwords of the instances and of the
+// bindings with their own role. Each rotation switches the login to the
+// other role of the pair, and the previous one keeps working for the
+// overlap so apps can pick up the new credentials.
+type CredentialRotator struct {
+	db       *gorm.DB
+	hosts    *HostRegistry
+	key      string
+	interval time.Duration
+	overlap  time.Duration
+
+	// Runs statements on the host of instance
+	exec func(instance *Instance, statements []string) error
+	// Keeps the other rotations of instance waiting until unlock is called
+	lock func(instance *Instance) (unlock func(), err error)
+}
+
+func NewCredentialRotator(db *gorm.DB, hosts *HostRegistry, s *Settings) *CredentialRotator {
+	rotator := &CredentialRotator{
+		db:       db,
+		hosts:    hosts,
+		key:      s.EncryptionKey,
+		interval: s.RotationInterval,
+		overlap:  s.RotationOverlap,
+	}
+	rotator.exec = rotator.execOnHost
+	// SQLite has no advisory locks
+	rotator.lock = func(*Instance) (func(), error) { return func() {}, nil }
+	if s.Dialect == "postgres" {
+		rotator.lock = rotator.lockRotation
+	}
+
+	return rotator
+}
+
+func (cr *CredentialRotator) execOnHost(instance *Instance, statements []string) error {
+	host, err := cr.hosts.HostFor(instance)
+	if err != nil {
+		return err
+	}
+	return execAll(host.DB, Log.With("instance_id", instance.Uuid), statements)
+}
+
+// Run retires the previous logins whose overlap is over and, when there is
+// an interval, rotates the instances due until stop is closed
+func (cr *CredentialRotator) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(RotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		cr.RetireDue()
+		if cr.interval > 0 {
+			cr.RotateDue()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RotateDue rotates the instances whose last rotation, or creation, is
+// older than the interval
+func (cr *CredentialRotator) RotateDue() {
+	due := time.Now().Add(-cr.interval)
+
+	var instances []Instance
+	cr.db.Where("retiring_role = '' OR retiring_role IS NULL").Find(&instances)
+
+	for i := range instances {
+		instance := &instances[i]
+		last := instance.RotatedAt
+		if last.IsZero() {
+			last = instance.CreatedAt
+		}
+		if last.After(due) {
+			continue
+		}
+
+		if err := cr.RotateInstance(instance); err != nil && err != ErrRotationInProgress {
+			Log.Error("Error rotating the credentials", err, "instance_id", instance.Uuid)
+		}
+	}
+}
+
+// RotateInstance gives the instance, and its bindings with their own role,
+// a new login and password. The instance is read again once the other
+// rotations are done, and ErrRotationInProgress returned if one of them
+// rotated it.
+func (cr *CredentialRotator) RotateInstance(instance *Instance) error {
+	unlock, err := cr.lock(instance)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := cr.db.First(instance, instance.Id).Error; err != nil {
+		return err
+	}
+	if instance.RetiringRole != "" {
+		return ErrRotationInProgress
+	}
+
+	password := randStr(25)
+	next := nextLoginRole(instance.Username, instance.LoginRole)
+	statements := RotationStatements(instance.Username, next, password, InstanceProfile(instance).Statements(next))
+	if err := cr.exec(instance, statements); err != nil {
+		return err
+	}
+
+	instance.RetiringRole = instance.LoginUsername()
+	instance.LoginRole = next
+	instance.RetireAt = time.Now().Add(cr.overlap)
+	instance.RotatedAt = time.Now()
+	// The salt is the IV of the encryption, which must not be reused
+	instance.Salt = GenerateSalt(aes.BlockSize)
+	if err := instance.SetPassword(password, cr.key); err != nil {
+		return err
+	}
+	if err := cr.db.Save(instance).Error; err != nil {
+		return err
+	}
+	Log.Info("Rotated the credentials", "instance_id", instance.Uuid, "login_role", next)
+
+	var bindings []Binding
+	cr.db.Where("instance_uuid = ? AND username <> ''", instance.Uuid).Find(&bindings)
+	for i := range bindings {
+		if err := cr.RotateBinding(instance, &bindings[i]); err != nil {
+			Log.Error("Error rotating the credentials", err, "instance_id", instance.Uuid, "binding_id", bindings[i].Uuid)
+		}
+	}
+
+	return nil
+}
+
+// RotateBinding gives the role of the binding a new login and password
+func (cr *CredentialRotator) RotateBinding(instance *Instance, binding *Binding) error {
+	if binding.RetiringRole != "" {
+		return ErrRotationInProgress
+	}
+
+	password := randStr(25)
+	next := nextLoginRole(binding.Username, binding.LoginRole)
+	extra := InstanceProfile(instance).Statements(next)
+	if !binding.ValidUntil.IsZero() {
+		extra = append(extra, fmt.Sprintf("ALTER ROLE %s VALID UNTIL '%s'", next, binding.ValidUntil.Format(time.RFC3339)))
+	}
+	if err := cr.exec(instance, RotationStatements(binding.Username, next, password, extra)); err != nil {
+		return err
+	}
+
+	binding.RetiringRole = binding.LoginUsername()
+	binding.LoginRole = next
+	binding.RetireAt = time.Now().Add(cr.overlap)
+	binding.RotatedAt = time.Now()
+	binding.Salt = GenerateSalt(aes.BlockSize)
+	if err := binding.SetPassword(password, cr.key); err != nil {
+		return err
+	}
+	if err := cr.db.Save(binding).Error; err != nil {
+		return err
+	}
+	Log.Info("Rotated the credentials", "instance_id", instance.Uuid, "binding_id", binding.Uuid, "login_role", next)
+
+	return nil
+}
+
+// RetireDue stops the previous logins whose overlap is over
+func (cr *CredentialRotator) RetireDue() {
+	now := time.Now()
+
+	var instances []Instance
+	cr.db.Where("retiring_role <> '' AND retire_at < ?", now).Find(&instances)
+	for i := range instances {
+		instance := &instances[i]
+		if err := cr.exec(instance, RetireStatements(instance.RetiringRole)); err != nil {
+			Log.Error("Error retiring the previous credentials", err, "instance_id", instance.Uuid)
+			continue
+		}
+		cr.db.Model(instance).UpdateColumn("retiring_role", "")
+	}
+
+	var bindings []Binding
+	cr.db.Where("retiring_role <> '' AND retire_at < ?", now).Find(&bindings)
+	for i := range bindings {
+		binding := &bindings[i]
+		instance := Instance{}
+		cr.db.Where("uuid = ?", binding.InstanceUuid).First(&instance)
+		if instance.Id == 0 {
+			continue
+		}
+
+		if err := cr.exec(&instance, RetireStatements(binding.RetiringRole)); err != nil {
+			Log.Error("Error retiring the previous credentials", err, "instance_id", instance.Uuid, "binding_id", binding.Uuid)
+			continue
+		}
+		cr.db.Model(binding).UpdateColumn("retiring_role", "")
+	}
+}
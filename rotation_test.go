@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRotator(executed *[]string) *CredentialRotator {
+	s := Settings{EncryptionKey: "12345678901234567890123456789012", RotationInterval: time.Hour, RotationOverlap: time.Hour}
+	rotator := NewCredentialRotator(&DB, Hosts, &s)
+	rotator.exec = func(instance *Instance, statements []string) error {
+		*executed = append(*executed, statements...)
+		return nil
+	}
+	return rotator
+}
+
+func TestRotateInstance(t *testing.T) {
+	_, m := doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	doRequest(m, "/v2/service_instances/the_instance/service_bindings/the_binding", "PUT", true, appBinding())
+
+	var executed []string
+	rotator := newTestRotator(&executed)
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	owner := instance.Username
+	oldPassword, _ := instance.GetPassword(rotator.key)
+	oldSalt := instance.Salt
+
+	if err := rotator.RotateInstance(&instance); err != nil {
+		t.Fatal("The rotation failed", err)
+	}
+
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	if instance.LoginRole != TwinRole(owner) || instance.RetiringRole != owner {
+		t.Error("The login should move to the twin and it moved from", instance.RetiringRole, "to", instance.LoginRole)
+	}
+	if instance.Salt == oldSalt {
+		t.Error("The new password should be encrypted with a new salt")
+	}
+	newPassword, err := instance.GetPassword(rotator.key)
+	if err != nil || newPassword == oldPassword {
+		t.Error("The new password should be stored encrypted", err)
+	}
+	if !strings.Contains(strings.Join(executed, ";"), "ALTER ROLE "+TwinRole(owner)+" WITH LOGIN PASSWORD '"+newPassword+"'") {
+		t.Error("The twin should get the new password and the statements were", executed)
+	}
+
+	credentials, _ := Credentials(&instance, nil, Hosts, &Settings{EncryptionKey: rotator.key})
+	if credentials["username"] != TwinRole(owner) || credentials["password"] != newPassword {
+		t.Error("The credentials should use the new login and they use", credentials["username"])
+	}
+
+	// Both logins work until the overlap is over
+	if err := rotator.RotateInstance(&instance); err != ErrRotationInProgress {
+		t.Error("Rotating during the overlap should fail and it returned", err)
+	}
+	executed = nil
+	rotator.RetireDue()
+	if len(executed) > 0 {
+		t.Error("Nothing should be retired before the overlap is over and it ran", executed)
+	}
+
+	DB.Model(&instance).UpdateColumn("retire_at", time.Now().Add(-time.Minute))
+	rotator.RetireDue()
+	if len(executed) == 0 || executed[0] != "ALTER ROLE "+owner+" WITH NOLOGIN PASSWORD NULL" {
+		t.Error("The previous login should be retired and the statements were", executed)
+	}
+
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	if err := rotator.RotateInstance(&instance); err != nil {
+		t.Fatal("The second rotation failed", err)
+	}
+	if instance.LoginRole != owner || instance.RetiringRole != TwinRole(owner) {
+		t.Error("The login should move back to the owner and it moved to", instance.LoginRole)
+	}
+}
+
+func TestConcurrentRotations(t *testing.T) {
+	doRequest(nil, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+
+	var executed []string
+	rotator := newTestRotator(&executed)
+	// Like the advisory lock of each instance
+	locks := map[int64]*sync.Mutex{}
+	var locksMu sync.Mutex
+	rotator.lock = func(instance *Instance) (func(), error) {
+		locksMu.Lock()
+		if locks[instance.Id] == nil {
+			locks[instance.Id] = &sync.Mutex{}
+		}
+		lock := locks[instance.Id]
+		locksMu.Unlock()
+		lock.Lock()
+		return lock.Unlock, nil
+	}
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		copied := instance
+		go func() { errs <- rotator.RotateInstance(&copied) }()
+	}
+	first, second := <-errs, <-errs
+	if !(first == nil && second == ErrRotationInProgress) && !(first == ErrRotationInProgress && second == nil) {
+		t.Error("Only one of the concurrent rotations should go through and they returned", first, second)
+	}
+}
+
+func TestRotateDue(t *testing.T) {
+	_, m := doRequest(nil, "/v2/service_instances/old_instance", "PUT", true, newInstance())
+	doRequest(m, "/v2/service_instances/new_instance", "PUT", true, newInstance())
+	DB.Model(Instance{}).Where("uuid = ?", "old_instance").UpdateColumn("created_at", time.Now().Add(-2*time.Hour))
+
+	var executed []string
+	newTestRotator(&executed).RotateDue()
+
+	var old, recent Instance
+	DB.Where("uuid = ?", "old_instance").First(&old)
+	DB.Where("uuid = ?", "new_instance").First(&recent)
+	if old.RotatedAt.IsZero() {
+		t.Error("An instance older than the interval should be rotated")
+	}
+	if !recent.RotatedAt.IsZero() {
+		t.Error("A recent instance should not be rotated")
+	}
+}
+
+func TestRotateCredentialsAdmin(t *testing.T) {
+	url := "/admin/instances/the_instance/rotate"
+	res, m := doRequest(nil, url, "POST", true, nil)
+	if res.Code != 404 {
+		t.Error(url, "should return 404 for an unknown instance and it returned", res.Code)
+	}
+
+	doRequest(m, "/v2/service_instances/the_instance", "PUT", true, newInstance())
+	failHostStatement = "ALTER ROLE"
+	defer func() { failHostStatement = "" }()
+	res, _ = doRequest(m, url, "POST", true, nil)
+	if res.Code != 500 {
+		t.Error(url, "should fail when the role can't be changed and it returned", res.Code)
+	}
+
+	instance := Instance{}
+	DB.Where("uuid = ?", "the_instance").First(&instance)
+	if instance.LoginRole != "" {
+		t.Error("A failed rotation should keep the login and it moved to", instance.LoginRole)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/auth"
+
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How the platform authenticates to the broker API
+const (
+	ClientAuthBasic       = "basic"
+	ClientAuthCertificate = "certificate"
+	ClientAuthBoth        = "both"
+)
+
+// ServerTLSSettings is the TLS of the broker API, plain HTTP without a
+// CertFile
+type ServerTLSSettings struct {
+	CertFile string
+	KeyFile  string
+
+	// The CAs client certificates are checked against
+	ClientCAs *x509.CertPool
+	// One of the ClientAuth constants
+	ClientAuth string
+	// The names allowed in client certificates, any when empty
+	ClientNames []string
+}
+
+// NewServerTLSConfig returns the TLS config of the broker API, or nil when
+// it isn't served over HTTPS. Client certificates are optional at the
+// handshake, so the health checks keep working without one, and required
+// by ClientCertAuth.
+func NewServerTLSConfig(ts ServerTLSSettings) (*tls.Config, error) {
+	if ts.CertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := NewCertReloader(ts.CertFile, ts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if ts.ClientCAs != nil {
+		config.ClientCAs = ts.ClientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// LoadCertPool reads the PEM certificates in path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// CertReloader serves a certificate and reloads it when its files change,
+// so a renewed certificate is picked up without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the certificate, reloaded first if one of its
+// files changed. A certificate that can't be loaded, e.g. while it is
+// being written, leaves the previous one in place.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if modified, err := cr.lastModified(); err == nil && !modified.Equal(cr.modified) {
+		if err := cr.reload(); err != nil {
+			Log.Error("Error reloading the certificate", err, "cert_file", cr.certFile)
+		} else {
+			Log.Info("Reloaded the certificate", "cert_file", cr.certFile)
+		}
+	}
+	return cr.cert, nil
+}
+
+func (cr *CertReloader) reload() error {
+	modified, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.modified = modified
+	return nil
+}
+
+// lastModified returns when the certificate or the key last changed
+func (cr *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// ClientCertAuth only lets requests through with a verified client
+// certificate for one of names, or for any name when there are none
+func ClientCertAuth(names []string) martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		name, err := clientCertName(req, names)
+		if err != nil {
+			Log.Error("Client certificate rejected", err, "remote_addr", req.RemoteAddr)
+			http.Error(res, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		c.Map(auth.User(name))
+	}
+}
+
+// clientCertName returns the name the verified client certificate of req
+// is for
+func clientCertName(req *http.Request, names []string) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", errors.New("No verified client certificate")
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	if len(names) == 0 {
+		return cert.Subject.CommonName, nil
+	}
+
+	for _, name := range names {
+		if cert.Subject.CommonName == name {
+			return name, nil
+		}
+		for _, dnsName := range cert.DNSNames {
+			if dnsName == name {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("The certificate of %s is not allowed", cert.Subject.CommonName)
+}
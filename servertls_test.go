@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns the PEM of a certificate for name, and of its key
+func (ca *testCA) issue(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// issueFiles writes a certificate for name and its key, and returns their
+// paths
+func (ca *testCA) issueFiles(t *testing.T, name string) (certFile, keyFile string) {
+	certPEM, keyPEM := ca.issue(t, name)
+	return writeFile(t, "cert.pem", string(certPEM)), writeFile(t, "key.pem", string(keyPEM))
+}
+
+func (ca *testCA) client(t *testing.T, name string) *http.Client {
+	config := &tls.Config{RootCAs: ca.pool}
+	if name != "" {
+		certPEM, keyPEM := ca.issue(t, name)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func servedName(t *testing.T, cr *CertReloader) string {
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, "first")
+
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "first" {
+		t.Error("The reloader should serve the certificate and it served", name)
+	}
+
+	// A renewed certificate
+	certPEM, keyPEM := ca.issue(t, "renewed")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if name := servedName(t, cr); name != "renewed" {
+		t.Error("The reloader should pick up the renewed certificate and it served", name)
+	}
+
+	// A certificate being written
+	ioutil.WriteFile(certFile, []byte("half a certificate"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := servedName(t, cr); name != "renewed" {
+		t.Error("The reloader should keep the previous certificate when the new one is broken and it served", name)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, "broker")
+
+	for _, mode := range []string{ClientAuthCertificate, ClientAuthBoth} {
+		s := testSettings()
+		s.ServerTLS = ServerTLSSettings{
+			CertFile:    certFile,
+			KeyFile:     keyFile,
+			ClientCAs:   ca.pool,
+			ClientAuth:  mode,
+			ClientNames: []string{"cloud-controller"},
+		}
+		m, err := App(s, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Served like Serve does
+		server := &http.Server{Handler: m}
+		server.TLSConfig, err = NewServerTLSConfig(s.ServerTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(listener, "", "")
+		defer server.Close()
+
+		get := func(client *http.Client, url string, basic bool) int {
+			req, _ := http.NewRequest("GET", "https://"+listener.Addr().String()+url, nil)
+			if basic {
+				req.SetBasicAuth("default", "default")
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+
+		platform := ca.client(t, "cloud-controller")
+		if code := get(platform, "/v2/catalog", mode == ClientAuthBoth); code != 200 {
+			t.Error(mode, "the platform certificate should be accepted and it returned", code)
+		}
+		if code := get(ca.client(t, "someone-else"), "/v2/catalog", true); code != 401 {
+			t.Error(mode, "a certificate for another name should be rejected and it returned", code)
+		}
+		if code := get(ca.client(t, ""), "/v2/catalog", true); code != 401 {
+			t.Error(mode, "a request without a certificate should be rejected and it returned", code)
+		}
+		if code := get(ca.client(t, ""), "/admin/quotas", true); code != 200 {
+			t.Error(mode, "the admin API should only need the credentials and it returned", code)
+		}
+		if code := get(ca.client(t, ""), "/healthz", false); code != 200 {
+			t.Error(mode, "the health checks should not need a certificate and they returned", code)
+		}
+		if mode == ClientAuthBoth {
+			if code := get(platform, "/v2/catalog", false); code != 401 {
+				t.Error(mode, "the certificate alone should not be enough and it returned", code)
+			}
+		}
+	}
+}
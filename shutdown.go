@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/jinzhu/gorm"
+
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	OperationProvision   = "provision"
+	OperationDeprovision = "deprovision"
+
+	OperationInProgress = "in_progress"
+	OperationAbandoned  = "abandoned"
+)
+
+// Operations still in progress after this long belong to a broker that
+// died without recording them as abandoned
+var StaleOperationAge = 15 * time.Minute
+
+// Identifies the operations started by this process
+var processId = hex.EncodeToString(GenerateIv(8))
+
+// The key of the advisory lock every broker holds, shared, while it runs.
+// The admin commands that can't run along brokers take it exclusively.
+const brokerLockKey = 7317021643
+
+// HoldBrokerLock takes the broker lock on a connection of its own, which
+// keeps it until the process exits. SQLite has no advisory locks.
+func HoldBrokerLock(db *gorm.DB, dialect string) error {
+	if dialect != "postgres" {
+		return nil
+	}
+
+	conn, err := db.DB().Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock_shared($1)", brokerLockKey); err != nil {
+		conn.Close()
+		return fmt.Errorf("Error taking the broker lock: %s", err)
+	}
+	return nil
+}
+
+// StartOperation records that kind is about to run for instance
+func StartOperation(db *gorm.DB, kind string, instance *Instance) *PendingOperation {
+	op := &PendingOperation{
+		Kind:         kind,
+		State:        OperationInProgress,
+		Owner:        processId,
+		InstanceUuid: instance.Uuid,
+		Host:         instance.Host,
+		Database:     instance.Database,
+		Username:     instance.Username,
+		OrgGuid:      instance.OrgGuid,
+		SpaceGuid:    instance.SpaceGuid,
+		PlanId:       instance.PlanId,
+	}
+	if err := db.Create(op).Error; err != nil {
+		Log.Error("Error recording the operation", err, "instance_id", instance.Uuid, "operation", kind)
+	}
+	return op
+}
+
+// Finish forgets an operation that completed
+func (op *PendingOperation) Finish(db *gorm.DB) {
+	if op.Id > 0 {
+		db.Delete(op)
+	}
+}
+
+// Abandon records that an operation stopped halfway, so ResumeOperations
+// finishes it
+func (op *PendingOperation) Abandon(db *gorm.DB) {
+	if op.Id > 0 {
+		db.Model(op).UpdateColumn("state", OperationAbandoned)
+	}
+}
+
+// AbandonOperations marks the operations of this process that are still
+// running, so the next start knows it doesn't have to wait for them. The
+// binding operations are failed, so the platform stops polling them.
+func AbandonOperations(db *gorm.DB) int64 {
+	result := db.Model(PendingOperation{}).
+		Where("owner = ? AND state = ?", processId, OperationInProgress).
+		UpdateColumn("state", OperationAbandoned)
+	return result.RowsAffected + FailRunningBindings(db)
+}
+
+// ResumeOperations cleans up after the provisions and finishes the
+// deprovisions that were abandoned or whose broker died
+func ResumeOperations(db *gorm.DB, hosts *HostRegistry) {
+	var ops []PendingOperation
+	db.Where("state = ? OR (state = ? AND created_at < ?)",
+		OperationAbandoned, OperationInProgress, time.Now().Add(-StaleOperationAge)).Find(&ops)
+
+	for i := range ops {
+		op := &ops[i]
+		l := Log.With("instance_id", op.InstanceUuid, "operation", op.Kind, "host", op.Host)
+
+		host := hosts.Get(op.Host)
+		if host == nil {
+			l.Error("Can't resume the operation", fmt.Errorf("Unknown host %s", op.Host))
+			continue
+		}
+
+		instance := Instance{}
+		db.Where("uuid = ?", op.InstanceUuid).First(&instance)
+
+		switch op.Kind {
+		case OperationProvision:
+			if instance.Id > 0 {
+				// It got as far as saving the instance
+				break
+			}
+			ExecLogged(host.DB, l, fmt.Sprintf("DROP DATABASE IF EXISTS %s;", op.Database))
+			ExecLogged(host.DB, l, fmt.Sprintf("DROP USER IF EXISTS %s;", op.Username))
+			l.Info("Cleaned up an abandoned provision")
+		case OperationDeprovision:
+			ExecLogged(host.DB, l, fmt.Sprintf("DROP DATABASE IF EXISTS %s;", op.Database))
+			ExecLogged(host.DB, l, fmt.Sprintf("DROP USER IF EXISTS %s;", TwinRole(op.Username)))
+			ExecLogged(host.DB, l, fmt.Sprintf("DROP USER IF EXISTS %s;", op.Username))
+			if instance.Id > 0 {
+				db.Delete(&instance)
+			}
+			l.Info("Finished an abandoned deprovision")
+		}
+
+		op.Finish(db)
+	}
+}
+
+// The jobs running in the background of the app
+var BackgroundJobs *Jobs
+
+// Jobs keeps count of the background jobs so shutdown can wait for them
+type Jobs struct {
+	wg   sync.WaitGroup
+	stop chan struct{}
+}
+
+func NewJobs() *Jobs {
+	return &Jobs{stop: make(chan struct{})}
+}
+
+// Go runs job until the jobs are stopped
+func (j *Jobs) Go(job func(stop <-chan struct{})) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		job(j.stop)
+	}()
+}
+
+// Stop tells the jobs to stop and waits for them until timeout. It returns
+// false when some are still running.
+func (j *Jobs) Stop(timeout time.Duration) bool {
+	close(j.stop)
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Serve runs server until SIGTERM or SIGINT. Then it stops accepting
+// requests and waits up to timeout for the requests and the jobs in
+// flight. Whatever is left is recorded as abandoned. A server with a
+// TLSConfig serves HTTPS.
+func Serve(server *http.Server, jobs *Jobs, db *gorm.DB, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		Log.Info("Shutting down", "signal", sig.String(), "timeout", timeout.String())
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	clean := true
+	if err := server.Shutdown(ctx); err != nil {
+		Log.Error("Requests still running at shutdown", err)
+		clean = false
+	}
+	if !jobs.Stop(time.Until(deadline)) {
+		Log.Info("Jobs still running at shutdown")
+		clean = false
+	}
+
+	if !clean {
+		count := AbandonOperations(db)
+		Log.Info("Recorded the abandoned operations", "count", count)
+	}
+
+	Log.Info("Stopped")
+	return nil
+}
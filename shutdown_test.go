@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeOperations(t *testing.T) {
+	setup()
+
+	// A provision that never saved its instance
+	provisioned := Instance{Uuid: "half-created", Host: DefaultHostName, Database: "dbhalf", Username: "uhalf"}
+	StartOperation(&DB, OperationProvision, &provisioned)
+
+	// A deprovision that never deleted its instance
+	deprovisioned := Instance{Uuid: "half-deleted", Host: DefaultHostName, Database: "dbgone", Username: "ugone"}
+	DB.Save(&deprovisioned)
+	StartOperation(&DB, OperationDeprovision, &deprovisioned)
+
+	// A provision running in another broker
+	other := PendingOperation{Kind: OperationProvision, State: OperationInProgress, Owner: "other", Host: DefaultHostName}
+	DB.Save(&other)
+
+	if count := AbandonOperations(&DB); count != 2 {
+		t.Error("The operations of this process should be abandoned and it abandoned", count)
+	}
+
+	ResumeOperations(&DB, Hosts)
+
+	var ops []PendingOperation
+	DB.Find(&ops)
+	if len(ops) != 1 || ops[0].Owner != "other" {
+		t.Error("Only the operation running in another broker should be left and there are", ops)
+	}
+
+	i := Instance{}
+	DB.Where("uuid = ?", "half-deleted").First(&i)
+	if i.Id > 0 {
+		t.Error("The abandoned deprovision should be finished")
+	}
+}
+
+func TestJobsStop(t *testing.T) {
+	jobs := NewJobs()
+	stopped := false
+	jobs.Go(func(stop <-chan struct{}) {
+		<-stop
+		stopped = true
+	})
+
+	if !jobs.Stop(time.Second) || !stopped {
+		t.Error("Stop should wait for the jobs")
+	}
+
+	jobs = NewJobs()
+	jobs.Go(func(stop <-chan struct{}) {
+		time.Sleep(time.Second)
+	})
+	if jobs.Stop(10 * time.Millisecond) {
+		t.Error("Stop should give up on jobs that outlive the timeout")
+	}
+}
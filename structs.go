@@ -1,13 +1,29 @@
 package main
 
+import (
+	"encoding/json"
+)
+
 type Response struct {
 	Description string `json:"description"`
 }
 
 type Operation struct {
-	State                    string
-	Description              string
-	AsyncPollIntervalSeconds int `json:"async_poll_interval_seconds, omitempty"`
+	State                    string `json:"state"`
+	Description              string `json:"description,omitempty"`
+	AsyncPollIntervalSeconds int    `json:"async_poll_interval_seconds,omitempty"`
+}
+
+// The response to requests the spec gives an error code, like
+// ConcurrencyError
+type ErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"description"`
+}
+
+// The response to requests that continue in the background
+type AsyncResponse struct {
+	Operation string `json:"operation"`
 }
 
 type CreateResponse struct {
@@ -16,8 +32,35 @@ type CreateResponse struct {
 }
 
 type serviceReq struct {
-	ServiceId        string `json:"service_id"`
-	PlainId          string `json:"plan_id"`
-	OrganizationGuid string `json:"organization_guid"`
-	SpaceGuid        string `json:"space_guid"`
+	ServiceId        string          `json:"service_id"`
+	PlainId          string          `json:"plan_id"`
+	OrganizationGuid string          `json:"organization_guid"`
+	SpaceGuid        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters"`
+}
+
+type bindReq struct {
+	ServiceId    string          `json:"service_id"`
+	PlanId       string          `json:"plan_id"`
+	AppGuid      string          `json:"app_guid"`
+	BindResource bindResource    `json:"bind_resource"`
+	Parameters   json.RawMessage `json:"parameters"`
+}
+
+// What the binding is for. Service keys have no app.
+type bindResource struct {
+	AppGuid string `json:"app_guid"`
+	Route   string `json:"route"`
+}
+
+type instanceResponse struct {
+	ServiceId    string          `json:"service_id"`
+	PlanId       string          `json:"plan_id"`
+	DashboardUrl string          `json:"dashboard_url,omitempty"`
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+}
+
+type bindingResponse struct {
+	Credentials map[string]string `json:"credentials"`
+	Parameters  json.RawMessage   `json:"parameters,omitempty"`
 }